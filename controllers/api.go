@@ -0,0 +1,386 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"sigs.k8s.io/kustomize/api/resmap"
+	"sigs.k8s.io/kustomize/api/resource"
+)
+
+// Error codes returned in apiError.Code.
+const (
+	errBadRequest     = "bad_request"
+	errForbidden      = "forbidden"
+	errNotFound       = "not_found"
+	errBuildFailed    = "build_failed"
+	errTimeout        = "timeout"
+	errCanceled       = "canceled"
+	errGenerateFailed = "generate_failed"
+	errOutputDir      = "output_dir"
+	errExists         = "exists"
+	errPack           = "pack"
+	errClusterFailed  = "cluster_failed"
+	errTooMany        = "too_many_requests"
+)
+
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type resourceInfo struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	Namespace  string `json:"namespace,omitempty"`
+}
+
+type buildResponse struct {
+	YAML        string               `json:"yaml"`
+	Resources   []resourceInfo       `json:"resources"`
+	Warnings    []string             `json:"warnings"`
+	Validation  []resourceValidation `json:"validation"`
+	Lint        []lintFinding        `json:"lint"`
+	Provenance  []resourceProvenance `json:"provenance"`
+	KubeVersion string               `json:"kubeVersion,omitempty"`
+	Cached      bool                 `json:"cached"`
+	DurationMs  int64                `json:"durationMs"`
+	Error       *apiError            `json:"error,omitempty"`
+}
+
+// yamlPage is what yaml.html shows: the whole YAML, and every resource with
+// the validation errors found in it, both in build order and grouped by
+// namespace and kind.
+type yamlPage struct {
+	YAML        string
+	KubeVersion string
+	Resources   []yamlResource
+	Groups      []namespaceGroup
+	Kinds       []kindGroup
+	Warnings    []string
+	LintErrors  int
+	LintOthers  int
+}
+
+type yamlResource struct {
+	resourceInfo
+	YAML       string
+	Errors     []validationError
+	Lint       []lintFinding
+	Provenance *provenance
+}
+
+// namespaceGroup holds the resources of one namespace, or the cluster
+// scoped ones when Namespace is empty.
+type namespaceGroup struct {
+	Namespace string
+	Count     int
+	Kinds     []kindGroup
+}
+
+type kindGroup struct {
+	Kind      string
+	Resources []yamlResource
+}
+
+type generateResponse struct {
+	Path       string         `json:"path"`
+	Files      []scaffoldFile `json:"files"`
+	DurationMs int64          `json:"durationMs"`
+	Error      *apiError      `json:"error,omitempty"`
+}
+
+// APIBuild is the JSON counterpart of HandlerKust.
+func APIBuild(c echo.Context) error {
+	start := time.Now()
+	resp := newBuildResponse()
+	k := new(kustType)
+	if err := bindKust(c, k); err != nil {
+		return c.JSON(http.StatusBadRequest, resp.fail(start, errBadRequest, err))
+	}
+	if err := validateBuild(k); err != nil {
+		return c.JSON(http.StatusBadRequest, resp.fail(start, errBadRequest, err))
+	}
+
+	ctx, cancel := buildContext(c.Request().Context())
+	defer cancel()
+	status := runBuild(ctx, k, resp)
+	resp.DurationMs = since(start)
+	return c.JSON(status, resp)
+}
+
+func newBuildResponse() *buildResponse {
+	return &buildResponse{Resources: []resourceInfo{}, Warnings: []string{}, Validation: []resourceValidation{}, Lint: []lintFinding{}, Provenance: []resourceProvenance{}}
+}
+
+// newYAMLPage splits the YAML of a successful build back into its
+// resources, which m.AsYaml joined in order with "---" lines.
+func newYAMLPage(resp *buildResponse) *yamlPage {
+	page := &yamlPage{YAML: resp.YAML, KubeVersion: resp.KubeVersion, Warnings: resp.Warnings}
+	page.LintErrors = countSeverity(resp.Lint, severityError)
+	page.LintOthers = len(resp.Lint) - page.LintErrors
+	docs := strings.Split(strings.TrimPrefix(resp.YAML, "---\n"), "\n---\n")
+	if len(docs) != len(resp.Resources) {
+		return page
+	}
+	errs := make(map[resourceInfo][]validationError, len(resp.Validation))
+	for _, v := range resp.Validation {
+		errs[v.resourceInfo] = v.Errors
+	}
+	origins := make(map[resourceInfo]*provenance, len(resp.Provenance))
+	for i := range resp.Provenance {
+		origins[resp.Provenance[i].resourceInfo] = &resp.Provenance[i].provenance
+	}
+	lint := make(map[resourceInfo][]lintFinding)
+	for _, f := range sortedFindings(resp.Lint) {
+		lint[f.resourceInfo] = append(lint[f.resourceInfo], f)
+	}
+	for i, r := range resp.Resources {
+		page.Resources = append(page.Resources, yamlResource{
+			resourceInfo: r,
+			YAML:         strings.TrimSuffix(docs[i], "\n") + "\n",
+			Errors:       errs[r],
+			Lint:         lint[r],
+			Provenance:   origins[r],
+		})
+	}
+	page.Groups, page.Kinds = groupResources(page.Resources)
+	return page
+}
+
+// groupResources groups resources by namespace and then kind, both sorted
+// with cluster scoped resources first, and counts the resources of each
+// kind across namespaces.
+func groupResources(resources []yamlResource) ([]namespaceGroup, []kindGroup) {
+	byNamespace := make(map[string]map[string][]yamlResource)
+	byKind := make(map[string][]yamlResource)
+	for _, r := range resources {
+		kinds, ok := byNamespace[r.Namespace]
+		if !ok {
+			kinds = make(map[string][]yamlResource)
+			byNamespace[r.Namespace] = kinds
+		}
+		kinds[r.Kind] = append(kinds[r.Kind], r)
+		byKind[r.Kind] = append(byKind[r.Kind], r)
+	}
+	sortedKinds := func(m map[string][]yamlResource) []kindGroup {
+		list := make([]kindGroup, 0, len(m))
+		for kind, rs := range m {
+			list = append(list, kindGroup{Kind: kind, Resources: rs})
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Kind < list[j].Kind })
+		return list
+	}
+
+	groups := make([]namespaceGroup, 0, len(byNamespace))
+	for ns, kinds := range byNamespace {
+		g := namespaceGroup{Namespace: ns, Kinds: sortedKinds(kinds)}
+		for _, k := range g.Kinds {
+			g.Count += len(k.Resources)
+		}
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Namespace < groups[j].Namespace })
+	return groups, sortedKinds(byKind)
+}
+
+func (resp *buildResponse) fail(start time.Time, code string, err error) *buildResponse {
+	resp.DurationMs = since(start)
+	resp.Error = &apiError{Code: code, Message: err.Error()}
+	return resp
+}
+
+func validateBuild(k *kustType) error {
+	if k.Source != sourceLocal && k.GitPath == "" && k.Profile == "" {
+		return errMissing("git_path")
+	}
+	if k.Protocols != "" {
+		if err := checkProtocol(k.Protocols); err != nil {
+			return err
+		}
+	}
+	if k.KubeVersion != kubeVersionNone {
+		// fail before the build if the schema isn't there
+		if _, err := loadSchema(k.KubeVersion); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runBuild builds k into resp and returns the HTTP status that goes with
+// the outcome. It is shared by APIBuild and the build jobs.
+func runBuild(ctx context.Context, k *kustType, resp *buildResponse) int {
+	if k.Protocols == "http" && k.User != "" {
+		resp.Warnings = append(resp.Warnings, "credentials are sent in clear text over http")
+	}
+	fail := func(status int, code string, err error) int {
+		resp.Error = &apiError{Code: code, Message: err.Error()}
+		return status
+	}
+
+	m, err := kRun(ctx, k)
+	resp.Warnings = append(resp.Warnings, k.warnings()...)
+	if err != nil {
+		status, code := buildStatus(err)
+		if status == http.StatusInternalServerError {
+			log.Error(err)
+		}
+		return fail(status, code, err)
+	}
+	res, err := m.AsYaml()
+	if err != nil {
+		return fail(http.StatusInternalServerError, errBuildFailed, err)
+	}
+	resp.YAML = string(res)
+	resp.Cached = k.cached
+	resp.Resources = resourceList(m)
+	for _, r := range resp.Resources {
+		if p, ok := k.provenance[r]; ok {
+			resp.Provenance = append(resp.Provenance, resourceProvenance{resourceInfo: r, provenance: *p})
+		}
+	}
+	if len(resp.Resources) == 0 {
+		resp.Warnings = append(resp.Warnings, "the kustomization produced no resources")
+	}
+	validation, warnings, err := validateResources(m, k.KubeVersion)
+	if err != nil {
+		return fail(http.StatusBadRequest, errBadRequest, err)
+	}
+	resp.Validation = validation
+	resp.Warnings = append(resp.Warnings, warnings...)
+	if k.KubeVersion != kubeVersionNone {
+		s, _ := loadSchema(k.KubeVersion)
+		resp.KubeVersion = s.Version
+	}
+	if !k.SkipLint {
+		findings, warnings, err := lintResources(m)
+		if err != nil {
+			log.Error(err)
+			return fail(http.StatusInternalServerError, errBuildFailed, err)
+		}
+		resp.Lint = findings
+		resp.Warnings = append(resp.Warnings, warnings...)
+	}
+	return http.StatusOK
+}
+
+// buildStatus maps a build error to an HTTP status and error code.
+func buildStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, errLocalFiles) || errors.Is(err, errExecPlugins) || errors.Is(err, errStarlarkPlugins) ||
+		errors.Is(err, errLoadNone) || errors.Is(err, errProfiles):
+		return http.StatusForbidden, errForbidden
+	case errors.Is(err, errBuildTimeout):
+		return http.StatusGatewayTimeout, errTimeout
+	case errors.Is(err, errBuildCanceled):
+		return http.StatusServiceUnavailable, errCanceled
+	}
+	return http.StatusInternalServerError, errBuildFailed
+}
+
+// APIGenerate is the JSON counterpart of GenerateKust.
+func APIGenerate(c echo.Context) error {
+	start := time.Now()
+	resp := &generateResponse{Files: []scaffoldFile{}}
+	fail := func(status int, code string, err error) error {
+		resp.DurationMs = since(start)
+		resp.Error = &apiError{Code: code, Message: err.Error()}
+		return c.JSON(status, resp)
+	}
+
+	g := new(generateType)
+	if err := c.Bind(g); err != nil {
+		return fail(http.StatusBadRequest, errBadRequest, err)
+	}
+	if g.AppName == "" && g.Values["appname"] == "" {
+		return fail(http.StatusBadRequest, errBadRequest, errMissing("appname"))
+	}
+	if err := g.check(); err != nil {
+		return fail(http.StatusBadRequest, errBadRequest, err)
+	}
+	generate := handlerTemplate
+	if g.Preview {
+		generate = planScaffold
+	}
+	plan, err := generate(c.Request().Context(), g)
+	if plan != nil {
+		resp.Path, resp.Files = plan.Dir, plan.Files
+	}
+	if err != nil {
+		log.Error(err)
+		status, code := generateStatus(err)
+		return fail(status, code, err)
+	}
+	resp.DurationMs = since(start)
+	return c.JSON(http.StatusOK, resp)
+}
+
+// generateStatus maps an error of handlerTemplate to an HTTP status and an
+// apiError code.
+func generateStatus(err error) (int, string) {
+	var dirErr *outputDirError
+	var existsErr *existingFilesError
+	var packErr *packError
+	var fieldErr *fieldError
+	switch {
+	case errors.Is(err, errLocalFiles):
+		return http.StatusForbidden, errForbidden
+	case errors.As(err, &dirErr):
+		return http.StatusUnprocessableEntity, errOutputDir
+	case errors.As(err, &existsErr):
+		return http.StatusConflict, errExists
+	case errors.As(err, &packErr):
+		return http.StatusUnprocessableEntity, errPack
+	case errors.As(err, &fieldErr):
+		return http.StatusBadRequest, errBadRequest
+	}
+	return http.StatusInternalServerError, errGenerateFailed
+}
+
+func resourceList(m resmap.ResMap) []resourceInfo {
+	list := make([]resourceInfo, 0, m.Size())
+	for _, r := range m.Resources() {
+		list = append(list, newResourceInfo(r))
+	}
+	return list
+}
+
+func newResourceInfo(r *resource.Resource) resourceInfo {
+	gvk := r.GetGvk()
+	apiVersion := gvk.Version
+	if gvk.Group != "" {
+		apiVersion = gvk.Group + "/" + gvk.Version
+	}
+	return resourceInfo{
+		APIVersion: apiVersion,
+		Kind:       gvk.Kind,
+		Name:       r.GetName(),
+		Namespace:  r.GetNamespace(),
+	}
+}
+
+// String is how a resource is named in command line output.
+func (r resourceInfo) String() string {
+	name := r.Name
+	if r.Namespace != "" {
+		name = r.Namespace + "/" + name
+	}
+	return r.APIVersion + " " + r.Kind + " " + name
+}
+
+func errMissing(field string) error {
+	return fmt.Errorf("%s is required", field)
+}
+
+func since(start time.Time) int64 {
+	return int64(time.Since(start) / time.Millisecond)
+}
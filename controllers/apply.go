@@ -0,0 +1,338 @@
+package controllers
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/kustomize/api/resmap"
+)
+
+// Values of applyResult.Action.
+const (
+	actionCreated    = "created"
+	actionConfigured = "configured"
+	actionUnchanged  = "unchanged"
+	actionPruned     = "pruned"
+	actionFailed     = "failed"
+)
+
+// applyType is what to apply and where. YAML, such as the output shown on
+// the result page, is applied as it is; without it the build form is built
+// first. The build option Prune turns on pruning.
+type applyType struct {
+	kustType
+	clusterType
+	YAML   string `json:"yaml" form:"yaml" query:"yaml"`
+	DryRun bool   `json:"dry_run" form:"dry_run" query:"dry_run"`
+}
+
+type applyResult struct {
+	resourceInfo
+	Action string `json:"action"`
+	Error  string `json:"error,omitempty"`
+}
+
+type applyResponse struct {
+	Context    string        `json:"context"`
+	DryRun     bool          `json:"dryRun"`
+	Results    []applyResult `json:"results"`
+	Warnings   []string      `json:"warnings"`
+	DurationMs int64         `json:"durationMs"`
+	Error      *apiError     `json:"error,omitempty"`
+}
+
+func newApplyResponse() *applyResponse {
+	return &applyResponse{Results: []applyResult{}, Warnings: []string{}}
+}
+
+// count returns how many results have each action.
+func (resp *applyResponse) count() map[string]int {
+	n := make(map[string]int)
+	for _, r := range resp.Results {
+		n[r.Action]++
+	}
+	return n
+}
+
+// resources returns what a is to apply, built or parsed from a.YAML.
+func (a *applyType) resources(ctx context.Context) (resmap.ResMap, error) {
+	return resourcesFrom(ctx, &a.kustType, a.YAML)
+}
+
+// kApply applies objs in order and then, with prune set, deletes what the
+// inventory on the cluster lists and objs no longer have. The inventory
+// itself goes last, so that it only moves on once everything else went
+// through. A dry run asks the server for every step and changes nothing.
+// Failures of single objects are reported in their result and don't stop
+// the rest.
+func kApply(ctx context.Context, cl *clusterClient, objs []*unstructured.Unstructured, prune, dryRun bool) (*applyResponse, error) {
+	resp := newApplyResponse()
+	resp.Context, resp.DryRun = cl.context, dryRun
+
+	var inv *unstructured.Unstructured
+	var prev, cur *inventory
+	if prune {
+		var err error
+		if inv, cur, err = findInventory(objs); err != nil {
+			return nil, err
+		}
+		if inv == nil {
+			return nil, errNoInventory
+		}
+		if prev, err = cl.liveInventory(inv); err != nil {
+			return nil, fmt.Errorf("reading inventory %s: %v", inv.GetName(), err)
+		}
+	}
+
+	failed := false
+	for _, obj := range objs {
+		if obj == inv {
+			continue
+		}
+		if ctx.Err() != nil {
+			return nil, ctxError(ctx, ctx.Err())
+		}
+		r := cl.applyOne(obj, dryRun)
+		failed = failed || r.Action == actionFailed
+		resp.Results = append(resp.Results, r)
+	}
+	if inv == nil {
+		return resp, nil
+	}
+
+	for _, gone := range pruned(prev, cur) {
+		if ctx.Err() != nil {
+			return nil, ctxError(ctx, ctx.Err())
+		}
+		obj := new(unstructured.Unstructured)
+		obj.SetAPIVersion(gone.APIVersion)
+		obj.SetKind(gone.Kind)
+		obj.SetNamespace(gone.Namespace)
+		obj.SetName(gone.Name)
+		err := cl.remove(obj, dryRun)
+		r := applyResult{resourceInfo: objectInfo(obj), Action: actionPruned}
+		if err != nil {
+			r.Action, r.Error = actionFailed, err.Error()
+			failed = true
+		}
+		resp.Results = append(resp.Results, r)
+	}
+	if failed && !dryRun {
+		// keep the old inventory, the next apply prunes what this one left
+		resp.Warnings = append(resp.Warnings, "the inventory was not updated because some resources failed")
+		return resp, nil
+	}
+	resp.Results = append(resp.Results, cl.applyOne(inv, dryRun))
+	return resp, nil
+}
+
+func (cl *clusterClient) applyOne(obj *unstructured.Unstructured, dryRun bool) applyResult {
+	live, applied, err := cl.apply(obj, dryRun)
+	r := applyResult{resourceInfo: objectInfo(obj)}
+	if err != nil {
+		r.Action, r.Error = actionFailed, err.Error()
+		return r
+	}
+	if live == nil {
+		r.Action = actionCreated
+		return r
+	}
+	diff, _, err := changed(live, applied)
+	switch {
+	case err != nil:
+		r.Action, r.Error = actionFailed, err.Error()
+	case diff:
+		r.Action = actionConfigured
+	default:
+		r.Action = actionUnchanged
+	}
+	return r
+}
+
+// runApply builds or parses a and applies it to cl into resp, returning the
+// HTTP status that goes with the outcome.
+func runApply(ctx context.Context, a *applyType, cl *clusterClient, resp *applyResponse) int {
+	fail := func(status int, code string, err error) int {
+		resp.Error = &apiError{Code: code, Message: err.Error()}
+		return status
+	}
+	m, err := a.resources(ctx)
+	resp.Warnings = append(resp.Warnings, a.warnings()...)
+	if err != nil {
+		status, code := buildStatus(err)
+		if a.YAML != "" {
+			status, code = http.StatusBadRequest, errBadRequest
+		}
+		return fail(status, code, err)
+	}
+	objs, err := toUnstructured(m)
+	if err != nil {
+		return fail(http.StatusBadRequest, errBadRequest, err)
+	}
+	res, err := kApply(ctx, cl, objs, a.prune(), a.DryRun)
+	switch {
+	case err == errNoInventory:
+		return fail(http.StatusBadRequest, errBadRequest, err)
+	case errors.Is(err, errBuildTimeout) || err == errBuildCanceled:
+		status, code := buildStatus(err)
+		return fail(status, code, err)
+	case err != nil:
+		log.Error(err)
+		return fail(http.StatusInternalServerError, errClusterFailed, err)
+	}
+	res.Warnings = append(resp.Warnings, res.Warnings...)
+	*resp = *res
+	return http.StatusOK
+}
+
+// APIApply applies a build or YAML to a cluster. Clients are expected to
+// send a dry run first and show its results before applying for real.
+func APIApply(c echo.Context) error {
+	start := time.Now()
+	resp := newApplyResponse()
+	a := new(applyType)
+	if err := bindEmbedded(c, a, &a.kustType, &a.buildOptions, &a.clusterType); err != nil {
+		resp.Error = &apiError{Code: errBadRequest, Message: err.Error()}
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+	if a.YAML == "" {
+		if err := validateBuild(&a.kustType); err != nil {
+			resp.Error = &apiError{Code: errBadRequest, Message: err.Error()}
+			return c.JSON(http.StatusBadRequest, resp)
+		}
+	}
+	cl, err := a.connect()
+	if err != nil {
+		status, code := clusterStatus(err)
+		resp.Error = &apiError{Code: code, Message: err.Error()}
+		return c.JSON(status, resp)
+	}
+
+	ctx, cancel := buildContext(c.Request().Context())
+	defer cancel()
+	status := runApply(ctx, a, cl, resp)
+	resp.DurationMs = since(start)
+	return c.JSON(status, resp)
+}
+
+// ApplyCommand builds a source and applies it to a cluster from the command
+// line. It shows the server's dry run first and asks before applying,
+// unless -yes is given; -dry-run stops after the dry run.
+func ApplyCommand(args []string, in io.Reader, out io.Writer) error {
+	a := new(applyType)
+	fs := flag.NewFlagSet("apply", flag.ContinueOnError)
+	buildFlags(fs, &a.kustType)
+	clusterFlags(fs, &a.clusterType)
+	dryRun := fs.Bool("dry-run", false, "only show what the server would do")
+	yes := fs.Bool("yes", false, "apply without asking after the dry run")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: observer apply [-context <name>] [-prune] [flags] <source>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	switch {
+	case fs.NArg() == 1:
+		if err := setSource(&a.kustType, fs.Arg(0)); err != nil {
+			return err
+		}
+	case fs.NArg() == 0 && a.Profile != "":
+		a.Protocols = ""
+	default:
+		fs.Usage()
+		return fmt.Errorf("apply: expected exactly one source, got %d", fs.NArg())
+	}
+	cl, err := a.connect()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+	m, err := a.resources(ctx)
+	for _, w := range a.warnings() {
+		fmt.Fprintln(os.Stderr, "Warning:", w)
+	}
+	if err != nil {
+		return err
+	}
+	objs, err := toUnstructured(m)
+	if err != nil {
+		return err
+	}
+
+	resp, err := kApply(ctx, cl, objs, a.prune(), true)
+	if err != nil {
+		return err
+	}
+	if err := writeApply(out, resp); err != nil {
+		return err
+	}
+	if *dryRun {
+		return nil
+	}
+	if !*yes {
+		fmt.Fprintf(out, "\nApply to %s? [y/N] ", cl.context)
+		answer, _ := bufio.NewReader(in).ReadString('\n')
+		if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+			return fmt.Errorf("apply: canceled")
+		}
+	}
+	resp, err = kApply(ctx, cl, objs, a.prune(), false)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out)
+	if err := writeApply(out, resp); err != nil {
+		return err
+	}
+	if resp.count()[actionFailed] > 0 {
+		return fmt.Errorf("apply: %d resources failed", resp.count()[actionFailed])
+	}
+	return nil
+}
+
+// writeApply prints the results of an apply as a table.
+func writeApply(out io.Writer, resp *applyResponse) error {
+	for _, w := range resp.Warnings {
+		fmt.Fprintln(os.Stderr, "Warning:", w)
+	}
+	title := "Applied to"
+	if resp.DryRun {
+		title = "Dry run on"
+	}
+	fmt.Fprintf(out, "%s %s\n\n", title, resp.Context)
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "RESOURCE\tRESULT\tERROR")
+	for _, r := range resp.Results {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", r.resourceInfo, r.Action, r.Error)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	n := resp.count()
+	var parts []string
+	for _, action := range []string{actionCreated, actionConfigured, actionUnchanged, actionPruned, actionFailed} {
+		if n[action] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", n[action], action))
+		}
+	}
+	if len(parts) == 0 {
+		parts = append(parts, "nothing to do")
+	}
+	_, err := fmt.Fprintf(out, "\n%s\n", strings.Join(parts, ", "))
+	return err
+}
@@ -0,0 +1,396 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"sigs.k8s.io/kustomize/api/k8sdeps/kunstruct"
+	"sigs.k8s.io/kustomize/api/resmap"
+	"sigs.k8s.io/kustomize/api/resource"
+)
+
+// Remote builds are cached in two layers under the user cache directory: a
+// shallow clone per repo url and ref, fetched again only when the ref has
+// moved, and the rendered YAML per commit, path and build options.
+const (
+	reposDir   = "repos"
+	rendersDir = "renders"
+)
+
+// cacheEntry describes one cached clone. It is stored next to the clone as
+// <key>.json.
+type cacheEntry struct {
+	URL     string    `json:"url"`
+	Ref     string    `json:"ref"`
+	SHA     string    `json:"sha"`
+	Updated time.Time `json:"updated"`
+	Size    int64     `json:"size"`
+}
+
+type cacheInfo struct {
+	Dir     string        `json:"dir"`
+	Repos   []*cacheEntry `json:"repos"`
+	Renders int           `json:"renders"`
+	Size    int64         `json:"size"`
+}
+
+var (
+	// cacheMu is held for reading by builds and for writing by a purge.
+	cacheMu sync.RWMutex
+	// repoLocks holds a one slot channel per cached clone, so that two
+	// builds never check out different commits in the same directory and a
+	// waiting build can still be cancelled.
+	repoLocks sync.Map
+
+	fullSHA = regexp.MustCompile(`^[0-9a-f]{40}$`)
+)
+
+func cacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Join(dir, appName)
+	return dir, os.MkdirAll(dir, 0700)
+}
+
+func cacheKey(parts ...string) string {
+	h := sha256.New()
+	for _, p := range parts {
+		io.WriteString(h, p)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+// resolveRef asks the remote which commit spec.Ref points at, without
+// fetching anything. It returns an empty SHA when the ref can't be matched,
+// e.g. an abbreviated commit, and the build then goes uncached. An error
+// here also means the credentials don't grant access, so nothing cached is
+// handed out without them.
+func resolveRef(ctx context.Context, spec *repoSpec, cred *credentials) (string, error) {
+	ref := spec.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+	// a full commit needs no resolving, but the remote is still asked so
+	// that the credentials are checked before its cached build is used
+	query := ref
+	if fullSHA.MatchString(ref) {
+		query = "HEAD"
+	}
+	out, err := gitOutput(ctx, "", cred, "ls-remote", "--end-of-options", spec.CloneURL, query)
+	if err != nil {
+		return "", fmt.Errorf("resolving %s: %v", ref, err)
+	}
+	if query != ref {
+		return ref, nil
+	}
+	refs := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			refs[fields[1]] = fields[0]
+		}
+	}
+	// the order in which git itself resolves a short ref name
+	for _, name := range []string{ref, "refs/" + ref, "refs/tags/" + ref, "refs/heads/" + ref} {
+		if sha, ok := refs[name]; ok {
+			return sha, nil
+		}
+	}
+	return "", nil
+}
+
+// kRunCached builds spec at the commit sha from the cache, cloning or
+// updating the cached repo as needed. It reports whether the rendered output
+// came straight from the cache.
+func kRunCached(ctx context.Context, root string, spec *repoSpec, sha string, cred *credentials, o buildOptions) (resmap.ResMap, bool, error) {
+	cacheMu.RLock()
+	defer cacheMu.RUnlock()
+
+	render, err := renderPath(root, spec, sha, o)
+	if err != nil {
+		return nil, false, err
+	}
+	// exec plugins may read anything on this machine, so their output is
+	// not a function of the commit alone
+	cacheable := o.Plugins != pluginsExec
+	if cacheable {
+		if m, err := loadRender(render); err == nil {
+			progress(ctx, stageBuilding, "build of %s found in cache", shortSHA(sha))
+			return m, true, nil
+		}
+	}
+
+	key := cacheKey(spec.CloneURL, spec.Ref)
+	lock, _ := repoLocks.LoadOrStore(key, make(chan struct{}, 1))
+	select {
+	case lock.(chan struct{}) <- struct{}{}:
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+	defer func() { <-lock.(chan struct{}) }()
+
+	dir, err := syncClone(ctx, filepath.Join(root, reposDir, key), spec, sha, cred)
+	if err != nil {
+		return nil, false, err
+	}
+	m, err := kustomize(ctx, filepath.Join(dir, filepath.FromSlash(spec.Path)), o)
+	if err != nil {
+		return nil, false, err
+	}
+	if cacheable {
+		if err := saveRender(render, m); err != nil {
+			log.Warn("caching build: ", err)
+		}
+	}
+	return m, false, nil
+}
+
+// renderPath is where the build of spec at sha with o is cached.
+func renderPath(root string, spec *repoSpec, sha string, o buildOptions) (string, error) {
+	// the same build whether an option was left out or set to its default
+	opts, err := json.Marshal(o.merge(defaultBuildOptions()))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, rendersDir, cacheKey(spec.CloneURL, sha, spec.Path, string(opts))+".yaml"), nil
+}
+
+// syncClone makes dir a shallow clone of spec.Ref at sha. Nothing is fetched
+// when the cached clone is already there. A clone that fails to update, or
+// is interrupted half way, is removed rather than left in an unknown state.
+func syncClone(ctx context.Context, dir string, spec *repoSpec, sha string, cred *credentials) (string, error) {
+	meta := dir + ".json"
+	var e cacheEntry
+	if data, err := ioutil.ReadFile(meta); err == nil && json.Unmarshal(data, &e) == nil && e.SHA == sha {
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			progress(ctx, stageCloning, "cached clone is at %s", shortSHA(sha))
+			return dir, nil
+		}
+	}
+	progress(ctx, stageCloning, "fetching %s at %s", spec.CloneURL, shortSHA(sha))
+
+	ref := spec.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+	steps := [][]string{
+		{"fetch", "--quiet", "--depth=1", "--end-of-options", "origin", ref},
+		{"checkout", "--quiet", "--force", "FETCH_HEAD"},
+		{"clean", "--quiet", "-ffdx"},
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+		os.RemoveAll(dir)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return "", err
+		}
+		steps = append([][]string{{"init", "--quiet"}, {"remote", "add", "--", "origin", spec.CloneURL}}, steps...)
+	}
+	for _, args := range steps {
+		if err := runGit(ctx, dir, cred, args...); err != nil {
+			os.RemoveAll(dir)
+			os.Remove(meta)
+			return "", fmt.Errorf("cloning %s: %v", spec.CloneURL, err)
+		}
+	}
+
+	e = cacheEntry{URL: spec.CloneURL, Ref: spec.Ref, SHA: sha, Updated: time.Now()}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	return dir, writeFileAtomic(meta, data)
+}
+
+func loadRender(path string) (resmap.ResMap, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rf := resmap.NewFactory(resource.NewFactory(kunstruct.NewKunstructuredFactoryImpl()), nil)
+	return rf.NewResMapFromBytes(data)
+}
+
+func saveRender(path string, m resmap.ResMap) error {
+	data, err := m.AsYaml()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic keeps concurrent builds from reading a half written file.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func inspectCache() (*cacheInfo, error) {
+	root, err := cacheDir()
+	if err != nil {
+		return nil, err
+	}
+	cacheMu.RLock()
+	defer cacheMu.RUnlock()
+
+	info := &cacheInfo{Dir: root, Repos: []*cacheEntry{}}
+	metas, _ := filepath.Glob(filepath.Join(root, reposDir, "*.json"))
+	for _, meta := range metas {
+		data, err := ioutil.ReadFile(meta)
+		if err != nil {
+			continue
+		}
+		e := new(cacheEntry)
+		if json.Unmarshal(data, e) != nil {
+			continue
+		}
+		e.Size = dirSize(strings.TrimSuffix(meta, ".json"))
+		info.Repos = append(info.Repos, e)
+		info.Size += e.Size
+	}
+	sort.Slice(info.Repos, func(i, j int) bool { return info.Repos[i].Updated.After(info.Repos[j].Updated) })
+
+	renders, _ := ioutil.ReadDir(filepath.Join(root, rendersDir))
+	for _, fi := range renders {
+		if strings.HasSuffix(fi.Name(), ".yaml") {
+			info.Renders++
+			info.Size += fi.Size()
+		}
+	}
+	return info, nil
+}
+
+func purgeCache() error {
+	root, err := cacheDir()
+	if err != nil {
+		return err
+	}
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	for _, sub := range []string{reposDir, rendersDir} {
+		if err := os.RemoveAll(filepath.Join(root, sub)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(_ string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// InspectCache lists the cached clones and the number of cached builds.
+func InspectCache(c echo.Context) error {
+	info, err := inspectCache()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, info)
+}
+
+// PurgeCache removes all cached clones and builds.
+func PurgeCache(c echo.Context) error {
+	if err := purgeCache(); err != nil {
+		c.Logger().Error(err)
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// CacheCommand lists the build cache from the command line, or purges it
+// with -purge.
+func CacheCommand(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("cache", flag.ContinueOnError)
+	purge := fs.Bool("purge", false, "remove all cached clones and builds")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: observer cache [-purge]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *purge {
+		return purgeCache()
+	}
+	info, err := inspectCache()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "REPO\tREF\tCOMMIT\tSIZE\tUPDATED")
+	for _, e := range info.Repos {
+		ref := e.Ref
+		if ref == "" {
+			ref = "HEAD"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", e.URL, ref, shortSHA(e.SHA), humanSize(e.Size), e.Updated.Format(time.RFC3339))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "\n%d builds cached, %s in %s\n", info.Renders, humanSize(info.Size), info.Dir)
+	return err
+}
+
+func shortSHA(sha string) string {
+	if len(sha) > 12 {
+		return sha[:12]
+	}
+	return sha
+}
+
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
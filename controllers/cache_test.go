@@ -0,0 +1,196 @@
+package controllers
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderPath(t *testing.T) {
+	spec := &repoSpec{CloneURL: "https://github.com/org/repo", Ref: "main", Path: "deploy"}
+	sha := strings.Repeat("a", 40)
+	yes := true
+	tests := []struct {
+		name string
+		spec repoSpec
+		sha  string
+		o    buildOptions
+		same bool
+	}{
+		{name: "same build", spec: *spec, sha: sha, same: true},
+		{name: "defaults spelled out", spec: *spec, sha: sha, o: defaultBuildOptions(), same: true},
+		// the ref only matters through the commit it resolves to
+		{name: "other ref at the same commit", spec: repoSpec{CloneURL: spec.CloneURL, Ref: "v1", Path: spec.Path}, sha: sha, same: true},
+		{name: "clone url", spec: repoSpec{CloneURL: "https://github.com/org/fork", Ref: spec.Ref, Path: spec.Path}, sha: sha},
+		{name: "commit", spec: *spec, sha: strings.Repeat("b", 40)},
+		{name: "path", spec: repoSpec{CloneURL: spec.CloneURL, Ref: spec.Ref, Path: "deploy/prod"}, sha: sha},
+		{name: "prune", spec: *spec, sha: sha, o: buildOptions{Prune: &yes}},
+		{name: "load restrictions", spec: *spec, sha: sha, o: buildOptions{LoadRestrictions: "none"}},
+		{name: "plugins", spec: *spec, sha: sha, o: buildOptions{Plugins: pluginsStarlark}},
+	}
+	want, err := renderPath("/cache", spec, sha, buildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		got, err := renderPath("/cache", &tt.spec, tt.sha, tt.o)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if (got == want) != tt.same {
+			t.Errorf("%s: renderPath() = %s, base build %s, want same %v", tt.name, got, want, tt.same)
+		}
+	}
+}
+
+// gitRepo makes a repository in a temp dir with a kustomization whose
+// ConfigMap holds value. It returns the directory and a func that commits
+// the ConfigMap with another value.
+func gitRepo(t *testing.T, value string) (string, func(value string)) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir, err := ioutil.TempDir("", "repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+		}
+	}
+	commit := func(value string) {
+		files := map[string]string{
+			"kustomization.yaml": "resources:\n- cm.yaml\n",
+			"cm.yaml":            "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\ndata:\n  value: " + value + "\n",
+		}
+		for name, data := range files {
+			if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		git("add", "-A")
+		git("commit", "--quiet", "-m", value)
+	}
+	git("init", "--quiet")
+	commit(value)
+	return dir, commit
+}
+
+func TestSyncClone(t *testing.T) {
+	repo, commit := gitRepo(t, "one")
+	defer os.RemoveAll(repo)
+	root, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	ctx := context.Background()
+	spec := &repoSpec{CloneURL: "file://" + repo}
+	dir := filepath.Join(root, reposDir, cacheKey(spec.CloneURL, spec.Ref))
+	steps := []struct {
+		commit string
+		want   string
+	}{
+		{want: "one"},
+		{want: "one"},
+		// the ref moved, so the clone is fetched again
+		{commit: "two", want: "two"},
+		{want: "two"},
+	}
+	var last string
+	for i, step := range steps {
+		if step.commit != "" {
+			commit(step.commit)
+		}
+		sha, err := resolveRef(ctx, spec, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fullSHA.MatchString(sha) {
+			t.Fatalf("%d: resolveRef() = %q, want a commit", i, sha)
+		}
+		if changed := sha != last; changed != (i == 0 || step.commit != "") {
+			t.Errorf("%d: resolveRef() = %s after %s, changed %v", i, sha, last, changed)
+		}
+		last = sha
+		if _, err := syncClone(ctx, dir, spec, sha, nil); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, "cm.yaml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), "value: "+step.want) {
+			t.Errorf("%d: clone has\n%s\nwant value %s", i, data, step.want)
+		}
+	}
+
+	// a clone at the right commit is used without asking the remote
+	if err := os.Rename(repo, repo+".gone"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repo + ".gone")
+	if _, err := syncClone(ctx, dir, spec, last, nil); err != nil {
+		t.Errorf("syncClone() at the cached commit: %v", err)
+	}
+	if _, err := syncClone(ctx, dir, spec, strings.Repeat("0", 40), nil); err == nil {
+		t.Error("syncClone() at another commit without the remote succeeded")
+	}
+}
+
+func TestKRunCached(t *testing.T) {
+	repo, _ := gitRepo(t, "one")
+	defer os.RemoveAll(repo)
+	root, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer func(v bool) { LocalFiles = v }(LocalFiles)
+	LocalFiles = true
+
+	ctx := context.Background()
+	spec := &repoSpec{CloneURL: "file://" + repo}
+	sha, err := resolveRef(ctx, spec, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		o      buildOptions
+		cached []bool
+	}{
+		{name: "builtin", cached: []bool{false, true, true}},
+		{name: "exec plugins", o: buildOptions{Plugins: pluginsExec, PluginRoot: root}, cached: []bool{false, false}},
+	}
+	for _, tt := range tests {
+		for i, want := range tt.cached {
+			m, cached, err := kRunCached(ctx, root, spec, sha, nil, tt.o)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if m.Size() != 1 {
+				t.Errorf("%s: %d: built %d resources, want 1", tt.name, i, m.Size())
+			}
+			if cached != want {
+				t.Errorf("%s: %d: cached %v, want %v", tt.name, i, cached, want)
+			}
+		}
+		render, err := renderPath(root, spec, sha, tt.o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(render); os.IsNotExist(err) != (tt.o.Plugins == pluginsExec) {
+			t.Errorf("%s: render saved: %v", tt.name, err == nil)
+		}
+	}
+}
@@ -0,0 +1,420 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/kustomize/api/resmap"
+)
+
+// Clusters allows diffing builds against, and applying them to, the
+// clusters in the kubeconfig of the machine the observer runs on. It lends
+// that machine's cluster credentials to everyone who can reach the UI, so
+// serve mode leaves it off unless asked to.
+var Clusters bool
+
+var errClusters = errors.New("cluster access is disabled on this server")
+
+// fieldManager is who server-side apply records our fields as owned by.
+const fieldManager = "kustomize-remote-observer"
+
+// clusterRequestTimeout bounds each call to the API server, which client-go
+// of this vintage can't tie to a context.
+const clusterRequestTimeout = 30 * time.Second
+
+// ignoredFields are left out of a cluster diff, they are written by the
+// server and never by a kustomization.
+var ignoredFields = [][]string{
+	{"status"},
+	{"metadata", "managedFields"},
+	{"metadata", "resourceVersion"},
+	{"metadata", "generation"},
+	{"metadata", "uid"},
+	{"metadata", "selfLink"},
+	{"metadata", "creationTimestamp"},
+}
+
+// clusterType picks a cluster from a kubeconfig. Empty fields fall back to
+// $KUBECONFIG or ~/.kube/config and its current context.
+type clusterType struct {
+	Kubeconfig string `json:"kubeconfig" form:"kubeconfig" query:"kubeconfig"`
+	Context    string `json:"context" form:"context" query:"context"`
+}
+
+// clusterDiffType is a build form plus the cluster to diff it against.
+type clusterDiffType struct {
+	kustType
+	clusterType
+}
+
+type kubeContext struct {
+	Name      string `json:"name"`
+	Cluster   string `json:"cluster"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+type kubeContexts struct {
+	Current  string        `json:"current"`
+	Contexts []kubeContext `json:"contexts"`
+}
+
+// clusterClient talks to one cluster on behalf of a build.
+type clusterClient struct {
+	context   string
+	namespace string
+	dynamic   dynamic.Interface
+	mapper    *restmapper.DeferredDiscoveryRESTMapper
+}
+
+func (ct clusterType) config() (clientcmd.ClientConfig, error) {
+	if !Clusters {
+		return nil, errClusters
+	}
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if ct.Kubeconfig != "" {
+		if !LocalFiles {
+			return nil, errLocalFiles
+		}
+		path, err := expandHome(ct.Kubeconfig)
+		if err != nil {
+			return nil, err
+		}
+		rules.ExplicitPath = path
+	}
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{CurrentContext: ct.Context}), nil
+}
+
+// contexts lists the contexts of the kubeconfig, sorted by name.
+func (ct clusterType) contexts() (*kubeContexts, error) {
+	cfg, err := ct.config()
+	if err != nil {
+		return nil, err
+	}
+	raw, err := cfg.RawConfig()
+	if err != nil {
+		return nil, err
+	}
+	list := &kubeContexts{Current: raw.CurrentContext, Contexts: []kubeContext{}}
+	for name, c := range raw.Contexts {
+		list.Contexts = append(list.Contexts, kubeContext{Name: name, Cluster: c.Cluster, Namespace: c.Namespace})
+	}
+	sort.Slice(list.Contexts, func(i, j int) bool { return list.Contexts[i].Name < list.Contexts[j].Name })
+	return list, nil
+}
+
+// connect returns a client for the chosen context. Nothing is sent to the
+// cluster until the first resource is looked up.
+func (ct clusterType) connect() (*clusterClient, error) {
+	cfg, err := ct.config()
+	if err != nil {
+		return nil, err
+	}
+	raw, err := cfg.RawConfig()
+	if err != nil {
+		return nil, err
+	}
+	name := ct.Context
+	if name == "" {
+		name = raw.CurrentContext
+	}
+	rc, err := cfg.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	rc.Timeout = clusterRequestTimeout
+	ns, _, err := cfg.Namespace()
+	if err != nil {
+		return nil, err
+	}
+	dc, err := discovery.NewDiscoveryClientForConfig(rc)
+	if err != nil {
+		return nil, err
+	}
+	dyn, err := dynamic.NewForConfig(rc)
+	if err != nil {
+		return nil, err
+	}
+	return &clusterClient{
+		context:   name,
+		namespace: ns,
+		dynamic:   dyn,
+		mapper:    restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(dc)),
+	}, nil
+}
+
+// resourceFor returns the client for obj's kind, and gives a namespaced
+// obj without a namespace the one of the context, like kubectl does. An
+// unknown kind is looked up again in case an apply just created its CRD.
+func (cl *clusterClient) resourceFor(obj *unstructured.Unstructured) (dynamic.ResourceInterface, error) {
+	gvk := obj.GroupVersionKind()
+	gk := schema.GroupKind{Group: gvk.Group, Kind: gvk.Kind}
+	m, err := cl.mapper.RESTMapping(gk, gvk.Version)
+	if meta.IsNoMatchError(err) {
+		cl.mapper.Reset()
+		m, err = cl.mapper.RESTMapping(gk, gvk.Version)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if m.Scope.Name() != meta.RESTScopeNameNamespace {
+		return cl.dynamic.Resource(m.Resource), nil
+	}
+	if obj.GetNamespace() == "" {
+		obj.SetNamespace(cl.namespace)
+	}
+	return cl.dynamic.Resource(m.Resource).Namespace(obj.GetNamespace()), nil
+}
+
+// apply creates obj or server-side applies it over the live object, only
+// asking the server what would happen if dryRun is set. It returns the live
+// object, nil if there was none, and the object as applied.
+func (cl *clusterClient) apply(obj *unstructured.Unstructured, dryRun bool) (live, applied *unstructured.Unstructured, err error) {
+	ri, err := cl.resourceFor(obj)
+	if err != nil {
+		return nil, nil, err
+	}
+	var opts []string
+	if dryRun {
+		opts = []string{metav1.DryRunAll}
+	}
+	live, err = ri.Get(obj.GetName(), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		applied, err = ri.Create(obj, metav1.CreateOptions{DryRun: opts, FieldManager: fieldManager})
+		return nil, applied, err
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := obj.MarshalJSON()
+	if err != nil {
+		return nil, nil, err
+	}
+	force := true
+	applied, err = ri.Patch(obj.GetName(), k8stypes.ApplyPatchType, data, metav1.PatchOptions{
+		DryRun:       opts,
+		FieldManager: fieldManager,
+		Force:        &force,
+	})
+	return live, applied, err
+}
+
+// remove deletes obj and what it owns, or only checks that it could if
+// dryRun is set.
+func (cl *clusterClient) remove(obj *unstructured.Unstructured, dryRun bool) error {
+	ri, err := cl.resourceFor(obj)
+	if err != nil {
+		return err
+	}
+	policy := metav1.DeletePropagationBackground
+	opts := &metav1.DeleteOptions{PropagationPolicy: &policy}
+	if dryRun {
+		opts.DryRun = []string{metav1.DryRunAll}
+	}
+	err = ri.Delete(obj.GetName(), opts)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// changed reports whether applied differs from live in more than the
+// fields the server keeps to itself.
+func changed(live, applied *unstructured.Unstructured) (bool, []fieldDiff, error) {
+	var fields []fieldDiff
+	err := diffValue(&fields, "", withoutIgnoredFields(live), true, withoutIgnoredFields(applied), true)
+	return len(fields) > 0, fields, err
+}
+
+// toUnstructured converts the resources of a build into objects for the
+// dynamic client.
+func toUnstructured(m resmap.ResMap) ([]*unstructured.Unstructured, error) {
+	objs := make([]*unstructured.Unstructured, 0, m.Size())
+	for _, r := range m.Resources() {
+		data, err := r.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		obj := new(unstructured.Unstructured)
+		if err := obj.UnmarshalJSON(data); err != nil {
+			return nil, err
+		}
+		objs = append(objs, obj)
+	}
+	return objs, nil
+}
+
+func objectInfo(obj *unstructured.Unstructured) resourceInfo {
+	return resourceInfo{
+		APIVersion: obj.GetAPIVersion(),
+		Kind:       obj.GetKind(),
+		Name:       obj.GetName(),
+		Namespace:  obj.GetNamespace(),
+	}
+}
+
+// withoutIgnoredFields returns a copy of obj without ignoredFields.
+func withoutIgnoredFields(obj *unstructured.Unstructured) map[string]interface{} {
+	c := obj.DeepCopy()
+	for _, f := range ignoredFields {
+		unstructured.RemoveNestedField(c.Object, f...)
+	}
+	return c.Object
+}
+
+// kClusterDiff builds k and compares every resource with what the server
+// says it would become when applied: resources the cluster doesn't have
+// are added, and the fields a server-side apply would change are modified.
+// Resources the server rejects are listed as failed.
+func kClusterDiff(ctx context.Context, k *kustType, cl *clusterClient) (*diffResponse, error) {
+	m, err := kRun(ctx, k)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", k.source(), err)
+	}
+	objs, err := toUnstructured(m)
+	if err != nil {
+		return nil, err
+	}
+	d := &diffResponse{
+		Left:     "cluster " + cl.context,
+		Right:    k.source(),
+		Added:    []resourceDiff{},
+		Removed:  []resourceDiff{},
+		Modified: []resourceDiff{},
+		Failed:   []resourceDiff{},
+		Warnings: k.warnings(),
+	}
+	for _, obj := range objs {
+		if ctx.Err() != nil {
+			return nil, ctxError(ctx, ctx.Err())
+		}
+		live, applied, err := cl.apply(obj, true)
+		info := objectInfo(obj)
+		switch {
+		case err != nil:
+			d.Failed = append(d.Failed, resourceDiff{resourceInfo: info, Error: err.Error()})
+		case live == nil:
+			y, err := yamlValue(withoutIgnoredFields(applied))
+			if err != nil {
+				return nil, err
+			}
+			d.Added = append(d.Added, resourceDiff{resourceInfo: info, YAML: y + "\n"})
+		default:
+			diff, fields, err := changed(live, applied)
+			if err != nil {
+				return nil, err
+			}
+			if !diff {
+				d.Unchanged++
+				continue
+			}
+			d.Modified = append(d.Modified, resourceDiff{resourceInfo: info, Fields: fields})
+		}
+	}
+	for _, list := range [][]resourceDiff{d.Added, d.Modified, d.Failed} {
+		sortResourceDiffs(list)
+	}
+	return d, nil
+}
+
+// clusterStatus maps an error picking a cluster to an HTTP status and
+// error code.
+func clusterStatus(err error) (int, string) {
+	if err == errClusters || err == errLocalFiles {
+		return http.StatusForbidden, errForbidden
+	}
+	return http.StatusInternalServerError, errClusterFailed
+}
+
+// ListContexts lists the contexts of the kubeconfig for the cluster picker.
+func ListContexts(c echo.Context) error {
+	ct := new(clusterType)
+	if err := c.Bind(ct); err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+	list, err := ct.contexts()
+	if err != nil {
+		status, _ := clusterStatus(err)
+		return c.JSON(status, err.Error())
+	}
+	return c.JSON(http.StatusOK, list)
+}
+
+// APIClusterDiff builds a source and diffs it against a live cluster.
+func APIClusterDiff(c echo.Context) error {
+	start := time.Now()
+	d := new(diffResponse)
+	fail := func(status int, code string, err error) error {
+		d.DurationMs = since(start)
+		d.Error = &apiError{Code: code, Message: err.Error()}
+		return c.JSON(status, d)
+	}
+	cd := new(clusterDiffType)
+	if err := bindEmbedded(c, cd, &cd.kustType, &cd.buildOptions, &cd.clusterType); err != nil {
+		return fail(http.StatusBadRequest, errBadRequest, err)
+	}
+	if err := validateBuild(&cd.kustType); err != nil {
+		return fail(http.StatusBadRequest, errBadRequest, err)
+	}
+
+	cl, err := cd.connect()
+	if err != nil {
+		status, code := clusterStatus(err)
+		return fail(status, code, err)
+	}
+
+	ctx, cancel := buildContext(c.Request().Context())
+	defer cancel()
+	res, err := kClusterDiff(ctx, &cd.kustType, cl)
+	if err != nil {
+		status, code := buildStatus(err)
+		if status == http.StatusInternalServerError {
+			log.Error(err)
+		}
+		return fail(status, code, err)
+	}
+	res.DurationMs = since(start)
+	return c.JSON(http.StatusOK, res)
+}
+
+// HandlerClusterDiff renders the diff page for the build form's Diff
+// Cluster button.
+func HandlerClusterDiff(c echo.Context) error {
+	cd := new(clusterDiffType)
+	if err := bindEmbedded(c, cd, &cd.kustType, &cd.buildOptions, &cd.clusterType); err != nil {
+		return err
+	}
+	if err := validateBuild(&cd.kustType); err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+	cl, err := cd.connect()
+	if err != nil {
+		status, _ := clusterStatus(err)
+		return c.JSON(status, err.Error())
+	}
+	ctx, cancel := buildContext(c.Request().Context())
+	defer cancel()
+	d, err := kClusterDiff(ctx, &cd.kustType, cl)
+	if err != nil {
+		c.Logger().Error(err)
+		status, _ := buildStatus(err)
+		return c.JSON(status, err.Error())
+	}
+	return c.Render(http.StatusOK, "diff.html", d)
+}
@@ -0,0 +1,294 @@
+package controllers
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery/cached/memory"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/restmapper"
+	clienttesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/yaml"
+)
+
+// fakeCluster returns a client for a cluster that knows ConfigMaps,
+// Services and Deployments and holds objs. The fake dynamic client has no
+// server-side apply, so an apply patch is merged into the live object, and
+// like the fake it changes objects even on a dry run.
+func fakeCluster(t *testing.T, objs ...string) *clusterClient {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	tracker := clienttesting.NewObjectTracker(scheme, serializer.NewCodecFactory(scheme).UniversalDecoder())
+	for _, obj := range unstructuredOf(t, objs...) {
+		if obj.GetNamespace() == "" {
+			obj.SetNamespace("default")
+		}
+		gvk := obj.GroupVersionKind()
+		gvr := schema.GroupVersionResource{Group: gvk.Group, Version: gvk.Version, Resource: strings.ToLower(gvk.Kind) + "s"}
+		if err := tracker.Create(gvr, obj, obj.GetNamespace()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	objects := clienttesting.ObjectReaction(tracker)
+	dyn := fakedynamic.NewSimpleDynamicClient(scheme)
+	dyn.ReactionChain = nil
+	dyn.AddReactor("patch", "*", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		patch := action.(clienttesting.PatchActionImpl)
+		if patch.PatchType != k8stypes.ApplyPatchType {
+			return false, nil, nil
+		}
+		patch.PatchType = k8stypes.MergePatchType
+		return objects(patch)
+	})
+	dyn.AddReactor("*", "*", objects)
+
+	disc := &fakediscovery.FakeDiscovery{Fake: &clienttesting.Fake{Resources: []*metav1.APIResourceList{
+		{GroupVersion: "v1", APIResources: []metav1.APIResource{
+			{Name: "configmaps", Kind: "ConfigMap", Namespaced: true},
+			{Name: "services", Kind: "Service", Namespaced: true},
+		}},
+		{GroupVersion: "apps/v1", APIResources: []metav1.APIResource{
+			{Name: "deployments", Kind: "Deployment", Namespaced: true},
+		}},
+	}}}
+	return &clusterClient{
+		context:   "test",
+		namespace: "default",
+		dynamic:   dyn,
+		mapper:    restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(disc)),
+	}
+}
+
+const (
+	clusterService = `apiVersion: v1
+kind: Service
+metadata:
+  name: web
+spec:
+  ports:
+  - port: 80
+`
+	clusterDeployment = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 2
+`
+	clusterWidget = `apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: web
+`
+)
+
+// inventoryOf is an inventory ConfigMap called inv listing what.
+func inventoryOf(what string) string {
+	return `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: inv
+  annotations:
+    ` + inventoryAnnotation + `: '{"current":[` + what + `]}'
+`
+}
+
+// unstructuredOf decodes objects the way toUnstructured does, with whole
+// numbers as int64 like the dynamic client returns them.
+func unstructuredOf(t *testing.T, ys ...string) []*unstructured.Unstructured {
+	t.Helper()
+	objs := make([]*unstructured.Unstructured, 0, len(ys))
+	for _, y := range ys {
+		data, err := yaml.YAMLToJSON([]byte(y))
+		if err != nil {
+			t.Fatal(err)
+		}
+		obj := new(unstructured.Unstructured)
+		if err := obj.UnmarshalJSON(data); err != nil {
+			t.Fatal(err)
+		}
+		objs = append(objs, obj)
+	}
+	return objs
+}
+
+func TestKApply(t *testing.T) {
+	const (
+		service = `{"apiVersion":"v1","kind":"Service","name":"web","namespace":"default"}`
+		deploy  = `{"apiVersion":"apps/v1","kind":"Deployment","name":"web","namespace":"default"}`
+		old     = `{"apiVersion":"v1","kind":"ConfigMap","name":"old","namespace":"default"}`
+	)
+	oldConfig := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: old
+`
+	type result struct{ kind, name, action string }
+	tests := []struct {
+		name     string
+		live     []string
+		objs     []string
+		prune    bool
+		dryRun   bool
+		want     []result
+		warnings int
+		gone     []string
+	}{
+		{
+			name: "create and configure",
+			live: []string{strings.Replace(clusterDeployment, "replicas: 2", "replicas: 1", 1)},
+			objs: []string{clusterService, clusterDeployment},
+			want: []result{{"Service", "web", actionCreated}, {"Deployment", "web", actionConfigured}},
+		},
+		{
+			name: "unchanged",
+			live: []string{clusterService},
+			objs: []string{clusterService},
+			want: []result{{"Service", "web", actionUnchanged}},
+		},
+		{
+			name:  "prune",
+			live:  []string{clusterService, oldConfig, inventoryOf(service + "," + old)},
+			objs:  []string{clusterService, clusterDeployment, inventoryOf(service + "," + deploy)},
+			prune: true,
+			want: []result{
+				{"Service", "web", actionUnchanged},
+				{"Deployment", "web", actionCreated},
+				{"ConfigMap", "old", actionPruned},
+				{"ConfigMap", "inv", actionConfigured},
+			},
+			gone: []string{"old"},
+		},
+		{
+			name:  "first prune",
+			objs:  []string{clusterService, inventoryOf(service)},
+			prune: true,
+			want:  []result{{"Service", "web", actionCreated}, {"ConfigMap", "inv", actionCreated}},
+		},
+		{
+			name:     "failure keeps the inventory",
+			live:     []string{oldConfig, inventoryOf(old)},
+			objs:     []string{clusterWidget, inventoryOf(`{"apiVersion":"example.com/v1","kind":"Widget","name":"web"}`)},
+			prune:    true,
+			want:     []result{{"Widget", "web", actionFailed}, {"ConfigMap", "old", actionPruned}},
+			warnings: 1,
+			gone:     []string{"old"},
+		},
+		{
+			name:   "failure in a dry run",
+			objs:   []string{clusterWidget, inventoryOf("")},
+			prune:  true,
+			dryRun: true,
+			want:   []result{{"Widget", "web", actionFailed}, {"ConfigMap", "inv", actionCreated}},
+		},
+	}
+	for _, tt := range tests {
+		cl := fakeCluster(t, tt.live...)
+		resp, err := kApply(context.Background(), cl, unstructuredOf(t, tt.objs...), tt.prune, tt.dryRun)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var got []result
+		for _, r := range resp.Results {
+			got = append(got, result{r.Kind, r.Name, r.Action})
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: results %v, want %v", tt.name, got, tt.want)
+		}
+		if len(resp.Warnings) != tt.warnings {
+			t.Errorf("%s: warnings %v, want %d", tt.name, resp.Warnings, tt.warnings)
+		}
+		if resp.Context != "test" || resp.DryRun != tt.dryRun {
+			t.Errorf("%s: context %q and dry run %v", tt.name, resp.Context, resp.DryRun)
+		}
+		for _, name := range tt.gone {
+			cm := schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+			if _, err := cl.dynamic.Resource(cm).Namespace("default").Get(name, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+				t.Errorf("%s: ConfigMap %s is still there: %v", tt.name, name, err)
+			}
+		}
+	}
+}
+
+func TestKApplyNoInventory(t *testing.T) {
+	cl := fakeCluster(t)
+	if _, err := kApply(context.Background(), cl, unstructuredOf(t, clusterService), true, false); err != errNoInventory {
+		t.Errorf("pruning without an inventory returned %v, want %v", err, errNoInventory)
+	}
+}
+
+func TestKClusterDiff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cluster-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"kustomization.yaml": "resources:\n- resources.yaml\n",
+		"resources.yaml": clusterService + "---\n" + clusterDeployment + "---\n" + clusterWidget + `---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+data:
+  LOG_LEVEL: info
+`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func(v bool) { LocalFiles = v }(LocalFiles)
+	LocalFiles = true
+
+	cl := fakeCluster(t, strings.Replace(clusterService, "port: 80", "port: 8080", 1), `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+data:
+  LOG_LEVEL: info
+`)
+	d, err := kClusterDiff(context.Background(), &kustType{Source: sourceLocal, LocalPath: dir}, cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := func(list []resourceDiff) []string {
+		var out []string
+		for _, r := range list {
+			out = append(out, r.Kind+"/"+r.Name)
+		}
+		return out
+	}
+	if got := names(d.Added); !reflect.DeepEqual(got, []string{"Deployment/web"}) {
+		t.Errorf("added %v", got)
+	}
+	if got := names(d.Modified); !reflect.DeepEqual(got, []string{"Service/web"}) {
+		t.Errorf("modified %v", got)
+	} else if fields := d.Modified[0].Fields; len(fields) != 1 || fields[0].Path != "spec.ports[0].port" {
+		t.Errorf("modified fields %v", fields)
+	}
+	if got := names(d.Failed); !reflect.DeepEqual(got, []string{"Widget/web"}) {
+		t.Errorf("failed %v", got)
+	}
+	if d.Unchanged != 1 || len(d.Removed) != 0 {
+		t.Errorf("%d unchanged and %d removed, want 1 and 0", d.Unchanged, len(d.Removed))
+	}
+	if d.Left != "cluster test" {
+		t.Errorf("left %q", d.Left)
+	}
+}
@@ -0,0 +1,550 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"sigs.k8s.io/kustomize/api/resid"
+	"sigs.k8s.io/kustomize/api/resmap"
+	"sigs.k8s.io/kustomize/api/resource"
+	"sigs.k8s.io/yaml"
+)
+
+// ErrDifferences is returned by DiffCommand with -exit-code when the two
+// builds differ.
+var ErrDifferences = errors.New("the builds differ")
+
+// compareType is a build form plus the source to compare it against. For a
+// git source Against is another git path, or just "?ref=<ref>" for the same
+// path at another ref; for a local source it is another directory.
+type compareType struct {
+	kustType
+	Against         string `json:"against" form:"against" query:"against"`
+	IgnoreNamespace bool   `json:"ignore_namespace" form:"ignore_namespace" query:"ignore_namespace"`
+}
+
+// fieldDiff is one changed field of a modified resource. Old is empty for
+// an added field and New for a removed one, values are YAML.
+type fieldDiff struct {
+	Path string `json:"path"`
+	Old  string `json:"old,omitempty"`
+	New  string `json:"new,omitempty"`
+}
+
+type resourceDiff struct {
+	resourceInfo
+	YAML   string      `json:"yaml,omitempty"`
+	Fields []fieldDiff `json:"fields,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+type diffResponse struct {
+	Left       string         `json:"left"`
+	Right      string         `json:"right"`
+	Added      []resourceDiff `json:"added"`
+	Removed    []resourceDiff `json:"removed"`
+	Modified   []resourceDiff `json:"modified"`
+	Failed     []resourceDiff `json:"failed,omitempty"` // rejected by a cluster, see kClusterDiff
+	Unchanged  int            `json:"unchanged"`
+	Warnings   []string       `json:"warnings"`
+	DurationMs int64          `json:"durationMs"`
+	Error      *apiError      `json:"error,omitempty"`
+}
+
+func (d *diffResponse) empty() bool {
+	return len(d.Added)+len(d.Removed)+len(d.Modified) == 0
+}
+
+// source describes where k builds from, for the diff headings.
+func (k *kustType) source() string {
+	if k.Source == sourceLocal {
+		return k.LocalPath
+	}
+	return k.Protocols + "://" + k.GitPath
+}
+
+// againstPath applies against to gitPath: a bare "?ref=" swaps the ref of
+// gitPath, anything else replaces it.
+func againstPath(gitPath, against string) string {
+	if loc := refQuery.FindStringIndex(against); loc == nil || loc[0] != 0 {
+		return against
+	}
+	if loc := refQuery.FindStringIndex(gitPath); loc != nil {
+		gitPath = gitPath[:loc[0]]
+	}
+	return gitPath + against
+}
+
+// kCompare builds left, then the side it is compared against, and diffs
+// the two. against gets left after it ran, so the right side can share the
+// options a profile filled in, and its credentials if it is the same repo.
+func kCompare(ctx context.Context, left *kustType, against func(left kustType) (*kustType, error), ignoreNamespace bool) (*diffResponse, error) {
+	a, err := kRun(ctx, left)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", left.source(), err)
+	}
+	right, err := against(*left)
+	if err != nil {
+		return nil, err
+	}
+	if cloneURL(right.Protocols, right.GitPath) != cloneURL(left.Protocols, left.GitPath) {
+		right.dropCredentials()
+	}
+	b, err := kRun(ctx, right)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", right.source(), err)
+	}
+	d := &diffResponse{
+		Left:     left.source(),
+		Right:    right.source(),
+		Added:    []resourceDiff{},
+		Removed:  []resourceDiff{},
+		Modified: []resourceDiff{},
+		Warnings: append(append([]string{}, left.warnings()...), right.warnings()...),
+	}
+	return d, diffResMaps(d, a, b, ignoreNamespace)
+}
+
+// rightSide points a copy of left at c.Against.
+func (c *compareType) rightSide(left kustType) (*kustType, error) {
+	left.Profile = ""
+	if left.Source == sourceLocal {
+		left.LocalPath = c.Against
+	} else {
+		left.GitPath = againstPath(left.GitPath, c.Against)
+	}
+	return &left, nil
+}
+
+// diffID is what resources are matched by. An exact one is the resource's
+// own id, used where diffKey alone would match several on one side.
+type diffID struct {
+	resid.ResId
+	exact bool
+}
+
+// diffKey matches resources by resid.ResId, with the namespace normalised
+// so that "" and "default" are the same, or left out entirely. Generated
+// ConfigMaps and Secrets are matched without their hash suffix, which
+// changes with any change to their content.
+func diffKey(r *resource.Resource, ignoreNamespace bool) diffID {
+	id := resid.NewResIdWithNamespace(r.GetGvk(), r.GetName(), r.GetNamespace())
+	ns := id.EffectiveNamespace()
+	if ignoreNamespace {
+		ns = ""
+	}
+	name := id.Name
+	if id.Group == "" && (id.Kind == "ConfigMap" || id.Kind == "Secret") {
+		name = hashSuffix.ReplaceAllString(name, "")
+	}
+	return diffID{ResId: resid.NewResIdWithNamespace(id.Gvk, name, ns)}
+}
+
+// diffKeys keys the resources of a and b by diffKey. Resources whose key
+// is shared by others on the same side, such as Services of one name in
+// two namespaces with the namespace ignored, are keyed by their exact id
+// instead of overwriting one another.
+func diffKeys(a, b resmap.ResMap, ignoreNamespace bool) (left, right map[diffID]*resource.Resource) {
+	count := make(map[diffID][2]int)
+	sides := []resmap.ResMap{a, b}
+	for i, m := range sides {
+		for _, r := range m.Resources() {
+			k := diffKey(r, ignoreNamespace)
+			c := count[k]
+			c[i]++
+			count[k] = c
+		}
+	}
+	keyed := make([]map[diffID]*resource.Resource, len(sides))
+	for i, m := range sides {
+		keyed[i] = make(map[diffID]*resource.Resource, m.Size())
+		for _, r := range m.Resources() {
+			k := diffKey(r, ignoreNamespace)
+			if c := count[k]; c[0] > 1 || c[1] > 1 {
+				id := r.CurId()
+				k = diffID{ResId: resid.NewResIdWithNamespace(id.Gvk, id.Name, id.EffectiveNamespace()), exact: true}
+			}
+			keyed[i][k] = r
+		}
+	}
+	return keyed[0], keyed[1]
+}
+
+func diffResMaps(d *diffResponse, a, b resmap.ResMap, ignoreNamespace bool) error {
+	left, right := diffKeys(a, b, ignoreNamespace)
+
+	withYAML := func(r *resource.Resource) (resourceDiff, error) {
+		y, err := r.AsYAML()
+		return resourceDiff{resourceInfo: newResourceInfo(r), YAML: string(y)}, err
+	}
+	for id, r := range left {
+		other, ok := right[id]
+		if !ok {
+			rd, err := withYAML(r)
+			if err != nil {
+				return err
+			}
+			d.Removed = append(d.Removed, rd)
+			continue
+		}
+		var fields []fieldDiff
+		if err := diffValue(&fields, "", r.Map(), true, other.Map(), true); err != nil {
+			return err
+		}
+		if len(fields) == 0 {
+			d.Unchanged++
+			continue
+		}
+		d.Modified = append(d.Modified, resourceDiff{resourceInfo: newResourceInfo(other), Fields: fields})
+	}
+	for id, r := range right {
+		if _, ok := left[id]; !ok {
+			rd, err := withYAML(r)
+			if err != nil {
+				return err
+			}
+			d.Added = append(d.Added, rd)
+		}
+	}
+	for _, list := range [][]resourceDiff{d.Added, d.Removed, d.Modified} {
+		sortResourceDiffs(list)
+	}
+	return nil
+}
+
+func sortResourceDiffs(list []resourceDiff) {
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i].resourceInfo, list[j].resourceInfo
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+}
+
+// diffValue appends the differences between a and b, found at path, to out.
+// Maps are compared key by key and lists of named items, such as containers,
+// item by name; other lists only by index when their lengths agree.
+func diffValue(out *[]fieldDiff, path string, a interface{}, aok bool, b interface{}, bok bool) error {
+	if aok && bok {
+		switch av := a.(type) {
+		case map[string]interface{}:
+			if bv, ok := b.(map[string]interface{}); ok {
+				return diffMaps(out, path, av, bv)
+			}
+		case []interface{}:
+			if bv, ok := b.([]interface{}); ok {
+				if done, err := diffLists(out, path, av, bv); done || err != nil {
+					return err
+				}
+			}
+		}
+		if reflect.DeepEqual(a, b) {
+			return nil
+		}
+	}
+	f := fieldDiff{Path: path}
+	var err error
+	if aok {
+		if f.Old, err = yamlValue(a); err != nil {
+			return err
+		}
+	}
+	if bok {
+		if f.New, err = yamlValue(b); err != nil {
+			return err
+		}
+	}
+	*out = append(*out, f)
+	return nil
+}
+
+func diffMaps(out *[]fieldDiff, path string, a, b map[string]interface{}) error {
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		av, aok := a[k]
+		bv, bok := b[k]
+		if err := diffValue(out, fieldPath(path, k), av, aok, bv, bok); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffLists reports whether it could compare a and b element by element.
+func diffLists(out *[]fieldDiff, path string, a, b []interface{}) (bool, error) {
+	an, bn := itemNames(a), itemNames(b)
+	if an != nil && bn != nil {
+		right := make(map[string]interface{}, len(b))
+		for i, name := range bn {
+			right[name] = b[i]
+		}
+		seen := make(map[string]bool, len(a))
+		for i, name := range an {
+			seen[name] = true
+			bv, ok := right[name]
+			if err := diffValue(out, path+"[name="+name+"]", a[i], true, bv, ok); err != nil {
+				return true, err
+			}
+		}
+		for i, name := range bn {
+			if !seen[name] {
+				if err := diffValue(out, path+"[name="+name+"]", nil, false, b[i], true); err != nil {
+					return true, err
+				}
+			}
+		}
+		return true, nil
+	}
+	if len(a) != len(b) {
+		return false, nil
+	}
+	for i := range a {
+		if err := diffValue(out, path+"["+strconv.Itoa(i)+"]", a[i], true, b[i], true); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// itemNames returns the name of every item of a list of named maps, or nil
+// if the list is anything else.
+func itemNames(list []interface{}) []string {
+	if len(list) == 0 {
+		return nil
+	}
+	names := make([]string, len(list))
+	seen := make(map[string]bool, len(list))
+	for i, item := range list {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		name, ok := m["name"].(string)
+		if !ok || seen[name] {
+			return nil
+		}
+		names[i] = name
+		seen[name] = true
+	}
+	return names
+}
+
+var plainKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func fieldPath(path, key string) string {
+	if !plainKey.MatchString(key) {
+		return path + "[" + strconv.Quote(key) + "]"
+	}
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func yamlValue(v interface{}) (string, error) {
+	y, err := yaml.Marshal(v)
+	return strings.TrimSuffix(string(y), "\n"), err
+}
+
+// APICompare builds two sources and returns a resource by resource diff.
+func APICompare(c echo.Context) error {
+	start := time.Now()
+	d := new(diffResponse)
+	fail := func(status int, code string, err error) error {
+		d.DurationMs = since(start)
+		d.Error = &apiError{Code: code, Message: err.Error()}
+		return c.JSON(status, d)
+	}
+	cmp := new(compareType)
+	if err := bindEmbedded(c, cmp, &cmp.kustType, &cmp.buildOptions); err != nil {
+		return fail(http.StatusBadRequest, errBadRequest, err)
+	}
+	if err := validateCompare(cmp); err != nil {
+		return fail(http.StatusBadRequest, errBadRequest, err)
+	}
+
+	ctx, cancel := buildContext(c.Request().Context())
+	defer cancel()
+	res, err := kCompare(ctx, &cmp.kustType, cmp.rightSide, cmp.IgnoreNamespace)
+	if err != nil {
+		status, code := buildStatus(err)
+		if status == http.StatusInternalServerError {
+			log.Error(err)
+		}
+		return fail(status, code, err)
+	}
+	res.DurationMs = since(start)
+	return c.JSON(http.StatusOK, res)
+}
+
+// HandlerCompare renders the diff page for the build form's Compare button.
+func HandlerCompare(c echo.Context) error {
+	cmp := new(compareType)
+	if err := bindEmbedded(c, cmp, &cmp.kustType, &cmp.buildOptions); err != nil {
+		return err
+	}
+	if err := validateCompare(cmp); err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+	ctx, cancel := buildContext(c.Request().Context())
+	defer cancel()
+	d, err := kCompare(ctx, &cmp.kustType, cmp.rightSide, cmp.IgnoreNamespace)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+	return c.Render(http.StatusOK, "diff.html", d)
+}
+
+func validateCompare(cmp *compareType) error {
+	if err := validateBuild(&cmp.kustType); err != nil {
+		return err
+	}
+	if cmp.Against == "" {
+		return errMissing("against")
+	}
+	return nil
+}
+
+// DiffCommand compares two builds from the command line. The second source
+// takes the flags of the first and may be a git url, a local directory or
+// just "?ref=<ref>" for the first path at another ref. With -cluster it
+// compares a single build with what a cluster would make of it.
+func DiffCommand(args []string, out io.Writer) error {
+	k := new(kustType)
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	buildFlags(fs, k)
+	ct := new(clusterType)
+	clusterFlags(fs, ct)
+	cluster := fs.Bool("cluster", false, "diff one source against the live objects of a cluster")
+	ignoreNamespace := fs.Bool("ignore-namespace", false, "match resources by group, kind and name only")
+	exitCode := fs.Bool("exit-code", false, "exit with status 1 when the builds differ")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: observer diff [flags] <source> <source>")
+		fmt.Fprintln(fs.Output(), "       observer diff [flags] <git-url> ?ref=<ref>")
+		fmt.Fprintln(fs.Output(), "       observer diff -cluster [-context <name>] [flags] <source>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	want := 2
+	if *cluster {
+		want = 1
+	}
+	if fs.NArg() != want {
+		fs.Usage()
+		return fmt.Errorf("diff: expected %d sources, got %d", want, fs.NArg())
+	}
+	if err := setSource(k, fs.Arg(0)); err != nil {
+		return err
+	}
+	against := func(left kustType) (*kustType, error) {
+		left.Profile = ""
+		arg := fs.Arg(1)
+		if left.Source != sourceLocal && strings.HasPrefix(arg, "?") {
+			left.GitPath = againstPath(left.GitPath, arg)
+			return &left, nil
+		}
+		left.Source, left.LocalPath = "", ""
+		return &left, setSource(&left, arg)
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+	var d *diffResponse
+	var err error
+	if *cluster {
+		var cl *clusterClient
+		if cl, err = ct.connect(); err != nil {
+			return err
+		}
+		d, err = kClusterDiff(ctx, k, cl)
+	} else {
+		d, err = kCompare(ctx, k, against, *ignoreNamespace)
+	}
+	if d != nil {
+		for _, w := range d.Warnings {
+			fmt.Fprintln(os.Stderr, "Warning:", w)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := writeDiff(out, d); err != nil {
+		return err
+	}
+	if *exitCode && !d.empty() {
+		return ErrDifferences
+	}
+	return nil
+}
+
+// writeDiff prints d in a form close to a unified diff.
+func writeDiff(out io.Writer, d *diffResponse) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- %s\n+++ %s\n", d.Left, d.Right)
+	for _, r := range d.Removed {
+		fmt.Fprintf(&b, "\n- %s\n", r.resourceInfo)
+		writeLines(&b, "-   ", r.YAML)
+	}
+	for _, r := range d.Added {
+		fmt.Fprintf(&b, "\n+ %s\n", r.resourceInfo)
+		writeLines(&b, "+   ", r.YAML)
+	}
+	for _, r := range d.Modified {
+		fmt.Fprintf(&b, "\n~ %s\n", r.resourceInfo)
+		for _, f := range r.Fields {
+			fmt.Fprintf(&b, "  %s\n", f.Path)
+			writeLines(&b, "-   ", f.Old)
+			writeLines(&b, "+   ", f.New)
+		}
+	}
+	for _, r := range d.Failed {
+		fmt.Fprintf(&b, "\n! %s\n", r.resourceInfo)
+		writeLines(&b, "    ", r.Error)
+	}
+	fmt.Fprintf(&b, "\n%d added, %d removed, %d modified, %d unchanged",
+		len(d.Added), len(d.Removed), len(d.Modified), d.Unchanged)
+	if len(d.Failed) > 0 {
+		fmt.Fprintf(&b, ", %d failed", len(d.Failed))
+	}
+	b.WriteString("\n")
+	_, err := io.WriteString(out, b.String())
+	return err
+}
+
+func writeLines(b *strings.Builder, prefix, text string) {
+	if text == "" {
+		return
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		b.WriteString(prefix + line + "\n")
+	}
+}
@@ -0,0 +1,253 @@
+package controllers
+
+import (
+	"reflect"
+	"testing"
+
+	"sigs.k8s.io/kustomize/api/k8sdeps/kunstruct"
+	"sigs.k8s.io/kustomize/api/resmap"
+	"sigs.k8s.io/kustomize/api/resource"
+)
+
+// resMapOf parses the resources of a multi document YAML.
+func resMapOf(t *testing.T, y string) resmap.ResMap {
+	t.Helper()
+	rf := resmap.NewFactory(resource.NewFactory(kunstruct.NewKunstructuredFactoryImpl()), nil)
+	m, err := rf.NewResMapFromBytes([]byte(y))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestDiffResMaps(t *testing.T) {
+	tests := []struct {
+		name            string
+		a, b            string
+		ignoreNamespace bool
+		added           []string
+		removed         []string
+		modified        map[string][]string
+		unchanged       int
+	}{
+		{
+			name: "unchanged",
+			a: `apiVersion: v1
+kind: Service
+metadata:
+  name: web
+spec:
+  ports:
+  - port: 80
+`,
+			b: `apiVersion: v1
+kind: Service
+metadata:
+  name: web
+spec:
+  ports:
+  - port: 80
+`,
+			unchanged: 1,
+		},
+		{
+			name: "added, removed and modified",
+			a: `apiVersion: v1
+kind: Service
+metadata:
+  name: old
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 1
+  template:
+    spec:
+      containers:
+      - name: web
+        image: nginx:1.17
+      - name: sidecar
+        image: envoy:1.0
+`,
+			b: `apiVersion: v1
+kind: Service
+metadata:
+  name: new
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 3
+  template:
+    spec:
+      containers:
+      - name: sidecar
+        image: envoy:1.0
+      - name: web
+        image: nginx:1.19
+`,
+			added:   []string{"new"},
+			removed: []string{"old"},
+			modified: map[string][]string{
+				"web": {"spec.replicas", "spec.template.spec.containers[name=web].image"},
+			},
+		},
+		{
+			name: "generated configmap",
+			a: `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: web-config-7h2bkg6m5t
+data:
+  LOG_LEVEL: info
+`,
+			b: `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: web-config-c8fg9dm42b
+data:
+  LOG_LEVEL: debug
+`,
+			modified: map[string][]string{
+				"web-config-c8fg9dm42b": {"data.LOG_LEVEL", "metadata.name"},
+			},
+		},
+		{
+			name: "hand-written configmap that looks generated",
+			a: `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-monitoring
+`,
+			b: `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+`,
+			added:   []string{"app"},
+			removed: []string{"app-monitoring"},
+		},
+		{
+			name: "generated and hand-written configmap of one name",
+			a: `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: web-config
+data:
+  LOG_LEVEL: info
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: web-config-7h2bkg6m5t
+data:
+  LOG_LEVEL: info
+`,
+			b: `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: web-config
+data:
+  LOG_LEVEL: debug
+`,
+			removed:  []string{"web-config-7h2bkg6m5t"},
+			modified: map[string][]string{"web-config": {"data.LOG_LEVEL"}},
+		},
+		{
+			name: "other namespace",
+			a: `apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  namespace: dev
+`,
+			b: `apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  namespace: prod
+`,
+			added:   []string{"web"},
+			removed: []string{"web"},
+		},
+		{
+			name: "ignored namespace",
+			a: `apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  namespace: dev
+`,
+			b: `apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  namespace: prod
+`,
+			ignoreNamespace: true,
+			modified:        map[string][]string{"web": {"metadata.namespace"}},
+		},
+		{
+			name: "ignored namespace with one name in two namespaces",
+			a: `apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  namespace: dev
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  namespace: prod
+`,
+			b: `apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  namespace: prod
+`,
+			ignoreNamespace: true,
+			removed:         []string{"web"},
+			unchanged:       1,
+		},
+	}
+	names := func(list []resourceDiff) []string {
+		var out []string
+		for _, r := range list {
+			out = append(out, r.Name)
+		}
+		return out
+	}
+	for _, tt := range tests {
+		d := &diffResponse{}
+		if err := diffResMaps(d, resMapOf(t, tt.a), resMapOf(t, tt.b), tt.ignoreNamespace); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := names(d.Added); !reflect.DeepEqual(got, tt.added) {
+			t.Errorf("%s: added %v, want %v", tt.name, got, tt.added)
+		}
+		if got := names(d.Removed); !reflect.DeepEqual(got, tt.removed) {
+			t.Errorf("%s: removed %v, want %v", tt.name, got, tt.removed)
+		}
+		modified := make(map[string][]string)
+		for _, r := range d.Modified {
+			for _, f := range r.Fields {
+				modified[r.Name] = append(modified[r.Name], f.Path)
+			}
+		}
+		if len(modified) != 0 || len(tt.modified) != 0 {
+			if !reflect.DeepEqual(modified, tt.modified) {
+				t.Errorf("%s: modified %v, want %v", tt.name, modified, tt.modified)
+			}
+		}
+		if d.Unchanged != tt.unchanged {
+			t.Errorf("%s: %d unchanged, want %d", tt.name, d.Unchanged, tt.unchanged)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package controllers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"sigs.k8s.io/kustomize/api/k8sdeps/kunstruct"
+	"sigs.k8s.io/kustomize/api/resmap"
+	"sigs.k8s.io/kustomize/api/resource"
+)
+
+// Values of exportOptions.Format, empty means formatYAML.
+const (
+	formatYAML     = "yaml"
+	formatJSON     = "json"
+	formatJSONList = "jsonlist"
+)
+
+// Values of exportOptions.Archive. A tar archive is gzipped.
+const (
+	archiveTar = "tar"
+	archiveZip = "zip"
+)
+
+// defaultNaming names split files the way build -o always has.
+const defaultNaming = "{group}_{version}_{kind}_{name}"
+
+// exportName is the base name of single files and archives.
+const exportName = "resources"
+
+var namingField = regexp.MustCompile(`\{[a-z]+\}`)
+
+// exportOptions say how to write the resources of a build. Split writes
+// one file per resource, named after Naming, in which {group}, {version},
+// {kind}, {name}, {namespace} and {index} are replaced and the extension
+// of the format is added unless the pattern has one.
+type exportOptions struct {
+	Format  string `json:"format" form:"format" query:"format"`
+	Split   bool   `json:"split" form:"split" query:"split"`
+	Naming  string `json:"naming" form:"naming" query:"naming"`
+	Archive string `json:"archive" form:"archive" query:"archive"`
+}
+
+// exportType is what APIExport takes: YAML, such as the output shown on
+// the result page, or else the build form, and how to export it.
+type exportType struct {
+	kustType
+	exportOptions
+	YAML string `json:"yaml" form:"yaml" query:"yaml"`
+}
+
+type exportFile struct {
+	Name string
+	Data []byte
+}
+
+// check fills in the defaults of o and rejects what can't be written.
+func (o *exportOptions) check() error {
+	switch o.Format {
+	case "":
+		o.Format = formatYAML
+	case formatYAML, formatJSON, formatJSONList:
+	default:
+		return fmt.Errorf("unknown format %q, want %s, %s or %s", o.Format, formatYAML, formatJSON, formatJSONList)
+	}
+	switch o.Archive {
+	case "", archiveTar, archiveZip:
+	default:
+		return fmt.Errorf("unknown archive %q, want %s or %s", o.Archive, archiveTar, archiveZip)
+	}
+	if o.Split && o.Format == formatJSONList {
+		return fmt.Errorf("a %s can't be split, use %s", formatJSONList, formatJSON)
+	}
+	if o.Naming == "" {
+		o.Naming = defaultNaming
+	}
+	for _, field := range namingField.FindAllString(o.Naming, -1) {
+		switch field {
+		case "{group}", "{version}", "{kind}", "{name}", "{namespace}", "{index}":
+		default:
+			return fmt.Errorf("unknown field %s in naming %q", field, o.Naming)
+		}
+	}
+	return nil
+}
+
+func (o *exportOptions) ext() string {
+	if o.Format == formatYAML {
+		return ".yaml"
+	}
+	return ".json"
+}
+
+// exportFiles encodes m as o says, as one file or one per resource.
+func exportFiles(m resmap.ResMap, o *exportOptions) ([]exportFile, error) {
+	if !o.Split {
+		data, err := encodeResources(m.Resources(), o.Format)
+		if err != nil {
+			return nil, err
+		}
+		return []exportFile{{Name: exportName + o.ext(), Data: data}}, nil
+	}
+	files := make([]exportFile, 0, m.Size())
+	seen := make(map[string]bool)
+	for i, r := range m.Resources() {
+		data, err := encodeResources([]*resource.Resource{r}, o.Format)
+		if err != nil {
+			return nil, err
+		}
+		name, err := o.fileName(r, i)
+		if err != nil {
+			return nil, err
+		}
+		// resources of the same kind and name in two namespaces
+		ext := path.Ext(name)
+		base := strings.TrimSuffix(name, ext)
+		for n := 2; seen[name]; n++ {
+			name = base + "-" + strconv.Itoa(n) + ext
+		}
+		seen[name] = true
+		files = append(files, exportFile{Name: name, Data: data})
+	}
+	return files, nil
+}
+
+// fileName names the file of r, the i-th resource, after o.Naming. The
+// name may have directories but has to stay within the output.
+func (o *exportOptions) fileName(r *resource.Resource, i int) (string, error) {
+	gvk := r.GetGvk()
+	clean := func(s string) string {
+		return strings.NewReplacer("/", "_", "\\", "_").Replace(strings.ToLower(s))
+	}
+	name := strings.NewReplacer(
+		"{group}", clean(gvk.Group),
+		"{version}", clean(gvk.Version),
+		"{kind}", clean(gvk.Kind),
+		"{name}", clean(r.GetName()),
+		"{namespace}", clean(r.GetNamespace()),
+		"{index}", fmt.Sprintf("%03d", i+1),
+	).Replace(o.Naming)
+	name = strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+	if name == "" || name == "." {
+		return "", fmt.Errorf("naming %q gives %s an empty file name", o.Naming, newResourceInfo(r))
+	}
+	if path.Ext(name) == "" {
+		name += o.ext()
+	}
+	return name, nil
+}
+
+// encodeResources writes resources as a YAML stream, a JSON array or a
+// JSON List object. A single resource in JSON is the bare object.
+func encodeResources(resources []*resource.Resource, format string) ([]byte, error) {
+	if format == formatYAML {
+		var buf bytes.Buffer
+		for i, r := range resources {
+			y, err := r.AsYAML()
+			if err != nil {
+				return nil, err
+			}
+			if i > 0 {
+				buf.WriteString("---\n")
+			}
+			buf.Write(y)
+		}
+		return buf.Bytes(), nil
+	}
+	items := make([]interface{}, 0, len(resources))
+	for _, r := range resources {
+		items = append(items, r.Map())
+	}
+	var v interface{} = items
+	switch {
+	case format == formatJSONList:
+		v = map[string]interface{}{"apiVersion": "v1", "kind": "List", "items": items}
+	case len(items) == 1:
+		v = items[0]
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// writeArchive packs files into a gzipped tar or a zip.
+func writeArchive(w io.Writer, archive string, files []exportFile) error {
+	now := time.Now()
+	if archive == archiveZip {
+		zw := zip.NewWriter(w)
+		for _, f := range files {
+			fw, err := zw.CreateHeader(&zip.FileHeader{Name: f.Name, Method: zip.Deflate, Modified: now})
+			if err != nil {
+				return err
+			}
+			if _, err := fw.Write(f.Data); err != nil {
+				return err
+			}
+		}
+		return zw.Close()
+	}
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	for _, f := range files {
+		hdr := &tar.Header{Name: f.Name, Mode: 0644, Size: int64(len(f.Data)), ModTime: now, Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(f.Data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+func archiveName(archive string) string {
+	if archive == archiveZip {
+		return exportName + ".zip"
+	}
+	return exportName + ".tar.gz"
+}
+
+// writeExport writes files to output: an archive file, a directory for
+// split files or a single file. Without output a single file or an archive
+// goes to out.
+func writeExport(output string, out io.Writer, o *exportOptions, files []exportFile) error {
+	if o.Archive != "" {
+		if output == "" {
+			return writeArchive(out, o.Archive, files)
+		}
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		if err := writeArchive(f, o.Archive, files); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+	if !o.Split {
+		if output == "" {
+			_, err := out.Write(files[0].Data)
+			return err
+		}
+		return ioutil.WriteFile(output, files[0].Data, 0644)
+	}
+	if output == "" {
+		return fmt.Errorf("split output needs a directory or an archive")
+	}
+	for _, f := range files {
+		name := filepath.Join(output, filepath.FromSlash(f.Name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(name, f.Data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resourcesFrom builds k, or parses yamlData when it is set.
+func resourcesFrom(ctx context.Context, k *kustType, yamlData string) (resmap.ResMap, error) {
+	if yamlData == "" {
+		m, err := kRun(ctx, k)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", k.source(), err)
+		}
+		return m, nil
+	}
+	rf := resmap.NewFactory(resource.NewFactory(kunstruct.NewKunstructuredFactoryImpl()), nil)
+	return rf.NewResMapFromBytes([]byte(yamlData))
+}
+
+// APIExport sends a build or YAML back as a file to save: one YAML or JSON
+// file, or an archive. Split output always comes as an archive, a zip
+// unless a tar is asked for.
+func APIExport(c echo.Context) error {
+	start := time.Now()
+	e := new(exportType)
+	fail := func(status int, code string, err error) error {
+		return c.JSON(status, newBuildResponse().fail(start, code, err))
+	}
+	if err := bindEmbedded(c, e, &e.kustType, &e.buildOptions, &e.exportOptions); err != nil {
+		return fail(http.StatusBadRequest, errBadRequest, err)
+	}
+	if e.Split && e.Archive == "" {
+		e.Archive = archiveZip
+	}
+	if err := e.check(); err != nil {
+		return fail(http.StatusBadRequest, errBadRequest, err)
+	}
+	if e.YAML == "" {
+		if err := validateBuild(&e.kustType); err != nil {
+			return fail(http.StatusBadRequest, errBadRequest, err)
+		}
+	}
+
+	ctx, cancel := buildContext(c.Request().Context())
+	defer cancel()
+	m, err := resourcesFrom(ctx, &e.kustType, e.YAML)
+	if err != nil {
+		status, code := buildStatus(err)
+		if e.YAML != "" {
+			status, code = http.StatusBadRequest, errBadRequest
+		}
+		return fail(status, code, err)
+	}
+	files, err := exportFiles(m, &e.exportOptions)
+	if err != nil {
+		return fail(http.StatusBadRequest, errBadRequest, err)
+	}
+
+	if e.Archive == "" {
+		f := files[0]
+		contentType := "application/yaml"
+		if e.Format != formatYAML {
+			contentType = echo.MIMEApplicationJSONCharsetUTF8
+		}
+		c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", f.Name))
+		return c.Blob(http.StatusOK, contentType, f.Data)
+	}
+	var buf bytes.Buffer
+	if err := writeArchive(&buf, e.Archive, files); err != nil {
+		return fail(http.StatusInternalServerError, errBuildFailed, err)
+	}
+	contentType := "application/gzip"
+	if e.Archive == archiveZip {
+		contentType = "application/zip"
+	}
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", archiveName(e.Archive)))
+	return c.Blob(http.StatusOK, contentType, buf.Bytes())
+}
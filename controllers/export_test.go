@@ -0,0 +1,66 @@
+package controllers
+
+import "testing"
+
+func TestFileName(t *testing.T) {
+	m := resMapOf(t, `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  namespace: prod
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: Web/Config
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: ..
+  namespace: ../..
+`)
+	tests := []struct {
+		naming string
+		format string
+		i      int
+		res    int
+		want   string
+	}{
+		{defaultNaming, formatYAML, 0, 0, "apps_v1_deployment_web.yaml"},
+		{defaultNaming, formatJSON, 0, 0, "apps_v1_deployment_web.json"},
+		{defaultNaming, formatYAML, 1, 1, "_v1_configmap_web_config.yaml"},
+		{"{namespace}/{kind}-{name}", formatYAML, 0, 0, "prod/deployment-web.yaml"},
+		{"{index}-{kind}.yml", formatYAML, 4, 0, "005-deployment.yml"},
+		{"{namespace}-{name}.yaml", formatYAML, 2, 2, ".._..-...yaml"},
+		{"../../{kind}/{name}", formatYAML, 0, 0, "deployment/web.yaml"},
+		{"/etc/{name}", formatYAML, 0, 0, "etc/web.yaml"},
+	}
+	for _, tt := range tests {
+		o := &exportOptions{Naming: tt.naming, Format: tt.format}
+		got, err := o.fileName(m.Resources()[tt.res], tt.i)
+		if err != nil {
+			t.Errorf("fileName(%q): %v", tt.naming, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("fileName(%q) = %q, want %q", tt.naming, got, tt.want)
+		}
+	}
+
+	// names that climb out of the output, or are nothing at all
+	for _, tt := range []struct {
+		naming string
+		res    int
+	}{
+		{"/", 0},
+		{"..", 0},
+		{"{namespace}", 1},
+		{"{namespace}/{name}", 2},
+	} {
+		o := &exportOptions{Naming: tt.naming, Format: formatYAML}
+		if name, err := o.fileName(m.Resources()[tt.res], 0); err == nil {
+			t.Errorf("fileName(%q) = %q, want an error", tt.naming, name)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package controllers
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// LocalFiles allows builds of, and browsing through, the file system of the
+// machine the observer runs on. The window always sets it, serve mode only
+// when started with -local-files.
+var LocalFiles bool
+
+var errLocalFiles = errors.New("local files are disabled on this server")
+
+type dirListing struct {
+	Path          string   `json:"path"`
+	Parent        string   `json:"parent"`
+	Dirs          []string `json:"dirs"`
+	Kustomization bool     `json:"kustomization"`
+}
+
+// BrowseDirs lists the sub directories of ?path= for the folder picker,
+// starting at the home directory.
+func BrowseDirs(c echo.Context) error {
+	if !LocalFiles {
+		return c.JSON(http.StatusForbidden, errLocalFiles.Error())
+	}
+	path := c.QueryParam("path")
+	if path == "" {
+		path = "~"
+	}
+	path, err := expandHome(path)
+	if err == nil {
+		path, err = filepath.Abs(path)
+	}
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	l := &dirListing{Path: path, Dirs: []string{}}
+	if parent := filepath.Dir(path); parent != path {
+		l.Parent = parent
+	}
+	for _, fi := range files {
+		if strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		if fi.IsDir() {
+			l.Dirs = append(l.Dirs, fi.Name())
+		}
+	}
+	sort.Strings(l.Dirs)
+	l.Kustomization = hasKustomization(path)
+	return c.JSON(http.StatusOK, l)
+}
+
+func hasKustomization(dir string) bool {
+	for _, name := range []string{"kustomization.yaml", "kustomization.yml", "Kustomization"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
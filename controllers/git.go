@@ -0,0 +1,421 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Environment handed to git when it runs the observer as its askpass helper.
+// Credentials only ever live in the environment of the clone process.
+const (
+	askPassEnv     = "KUSTOMIZE_OBSERVER_ASKPASS"
+	askUsernameEnv = "KUSTOMIZE_OBSERVER_USERNAME"
+	askPasswordEnv = "KUSTOMIZE_OBSERVER_PASSWORD"
+)
+
+// errSSHKeys keeps remote callers of a server from cloning with its own
+// ssh identities, which live in the same ~/.ssh a local build would use.
+var errSSHKeys = fmt.Errorf("ssh clones with the keys of this machine: %w", errLocalFiles)
+
+// gitProtocols are the protocols a repo is cloned with. Others, such as
+// file and ext, would reach the disk and commands of this machine.
+var gitProtocols = []string{"http", "https", "ssh"}
+
+var (
+	refQuery = regexp.MustCompile(`\?(version|ref)=`)
+	// gitSuffix is a ".git" that ends a path segment, not one inside a name
+	// such as org.github.io.
+	gitSuffix = regexp.MustCompile(`\.git(/|$)`)
+)
+
+// repoSpec is a remote kustomization target split into the repository to
+// clone, the ref to check out and the kustomization directory inside it.
+type repoSpec struct {
+	CloneURL string
+	Ref      string
+	Path     string
+}
+
+// credentials are never part of repoSpec.CloneURL. For an SSH key the
+// Password holds its passphrase.
+type credentials struct {
+	Username string
+	Password string
+	SSHKey   string
+}
+
+func (c *credentials) secrets() []string {
+	if c == nil {
+		return nil
+	}
+	return []string{c.Password}
+}
+
+// env returns the variables that hand the credentials to a single git
+// process, either through GIT_ASKPASS or through GIT_SSH_COMMAND with an
+// explicit identity.
+func (c *credentials) env() ([]string, error) {
+	if c == nil || (c.Username == "" && c.SSHKey == "") {
+		return nil, nil
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	askPass := []string{
+		askPassEnv + "=1",
+		askUsernameEnv + "=" + c.Username,
+		askPasswordEnv + "=" + c.Password,
+	}
+	if c.SSHKey == "" {
+		return append(askPass, "GIT_ASKPASS="+self), nil
+	}
+
+	// IdentitiesOnly keeps ssh from offering the agent's keys instead.
+	ssh := "ssh -i " + shellQuote(c.SSHKey) + " -o IdentitiesOnly=yes -o StrictHostKeyChecking=accept-new"
+	if c.Password == "" {
+		return []string{"GIT_SSH_COMMAND=" + ssh + " -o BatchMode=yes"}, nil
+	}
+	env := append(askPass, "GIT_SSH_COMMAND="+ssh, "SSH_ASKPASS="+self, "SSH_ASKPASS_REQUIRE=force")
+	if os.Getenv("DISPLAY") == "" {
+		// ssh before 8.4 ignores SSH_ASKPASS unless DISPLAY is set.
+		env = append(env, "DISPLAY=:0")
+	}
+	return env, nil
+}
+
+// credentials picks the identity for kustType.Auth, used for this clone only.
+func (k *kustType) credentials() (*credentials, error) {
+	auth := k.Auth
+	if auth == "" {
+		switch {
+		case k.SSHKey != "":
+			auth = authSSH
+		case k.Token != "":
+			auth = authToken
+		case k.User != "":
+			auth = authPassword
+		default:
+			auth = authNone
+		}
+	}
+	// without a key ssh still offers ~/.ssh/id_* and the agent's keys
+	if (auth == authSSH || k.Protocols == "ssh") && !LocalFiles {
+		return nil, errSSHKeys
+	}
+	switch auth {
+	case authNone:
+		return nil, nil
+	case authPassword:
+		if k.User == "" {
+			return nil, errMissing("username")
+		}
+		return &credentials{Username: k.User, Password: k.Pass}, nil
+	case authToken:
+		if k.Token == "" {
+			return nil, errMissing("token")
+		}
+		user := k.User
+		if user == "" {
+			user = tokenUser(k.GitPath)
+		}
+		return &credentials{Username: user, Password: k.Token}, nil
+	case authSSH:
+		if k.SSHKey == "" {
+			return nil, errMissing("ssh_key")
+		}
+		key, err := expandHome(k.SSHKey)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(key); err != nil {
+			return nil, fmt.Errorf("ssh key: %v", err)
+		}
+		return &credentials{SSHKey: key, Password: k.SSHPassphrase}, nil
+	}
+	return nil, fmt.Errorf("unknown auth mode %q", k.Auth)
+}
+
+// dropCredentials clears whatever identity k would clone with.
+func (k *kustType) dropCredentials() {
+	k.Auth, k.User, k.Pass, k.Token = "", "", "", ""
+	k.SSHKey, k.SSHPassphrase = "", ""
+}
+
+// tokenUser is the user name that goes with an access token: GitHub expects
+// x-access-token, GitLab and most others accept oauth2.
+func tokenUser(gitPath string) string {
+	if strings.HasPrefix(strings.ToLower(gitPath), "github.com") {
+		return "x-access-token"
+	}
+	return "oauth2"
+}
+
+// parseGitPath splits a git path as typed into the build form, such as
+// github.com/org/repo/overlays/prod?ref=v1.0.0, the same way kustomize does:
+// the repo ends at "_git/<name>", a segment ending in ".git" or "//", otherwise it is the host
+// followed by two path segments.
+func parseGitPath(protocol, gitPath string) (*repoSpec, error) {
+	if err := checkProtocol(protocol); err != nil {
+		return nil, err
+	}
+	spec := new(repoSpec)
+	n := gitPath
+	if loc := refQuery.FindStringIndex(n); loc != nil {
+		spec.Ref = n[loc[1]:]
+		n = n[:loc[0]]
+	}
+	// git would take either for an option, such as --upload-pack
+	if strings.HasPrefix(spec.Ref, "-") {
+		return nil, fmt.Errorf("git path %q has a ref that starts with -", gitPath)
+	}
+	if strings.HasPrefix(n, "-") {
+		return nil, fmt.Errorf("git path %q starts with -", gitPath)
+	}
+	if protocol == "ssh" {
+		n = sshRepo(n)
+	}
+
+	var repo string
+	switch {
+	case strings.Contains(n, "_git/"):
+		i := strings.Index(n, "_git/") + len("_git/")
+		j := strings.Index(n[i:], "/")
+		if j < 0 {
+			j = len(n) - i
+		}
+		repo, spec.Path = n[:i+j], n[i+j:]
+	case gitSuffix.MatchString(n):
+		i := gitSuffix.FindStringIndex(n)[0] + len(".git")
+		repo, spec.Path = n[:i], n[i:]
+	case strings.Contains(n, "//"):
+		i := strings.Index(n, "//")
+		repo, spec.Path = n[:i], n[i+len("//"):]
+	default:
+		parts := strings.SplitN(n, "/", 4)
+		if len(parts) < 3 {
+			return nil, fmt.Errorf("git path %q lacks an org/repo", gitPath)
+		}
+		repo = strings.Join(parts[:3], "/")
+		if len(parts) == 4 {
+			spec.Path = parts[3]
+		}
+	}
+	if repo == "" {
+		return nil, fmt.Errorf("git path %q lacks a repo", gitPath)
+	}
+	spec.Path = strings.Trim(spec.Path, "/")
+	spec.CloneURL = fmt.Sprintf("%s://%s", protocol, repo)
+	return spec, nil
+}
+
+// checkProtocol rejects a protocol that isn't one of gitProtocols.
+func checkProtocol(protocol string) error {
+	for _, p := range gitProtocols {
+		if protocol == p {
+			return nil
+		}
+	}
+	return fmt.Errorf("protocol %q is not one of %s", protocol, strings.Join(gitProtocols, ", "))
+}
+
+// cloneURL is the repo that protocol and gitPath point at, https if protocol
+// is empty. It is empty if gitPath doesn't parse.
+func cloneURL(protocol, gitPath string) string {
+	if protocol == "" {
+		protocol = "https"
+	}
+	spec, err := parseGitPath(protocol, gitPath)
+	if err != nil {
+		return ""
+	}
+	return spec.CloneURL
+}
+
+// sshRepo turns the scp-like git@host:org/repo into git@host/org/repo for an
+// ssh:// url and defaults the user to git. A port after the colon is kept.
+func sshRepo(repo string) string {
+	at := strings.Index(repo, "@")
+	if at < 0 {
+		repo = "git@" + repo
+		at = len("git")
+	}
+	if i := strings.Index(repo[at:], ":"); i > 0 {
+		i += at
+		if i+1 < len(repo) && (repo[i+1] < '0' || repo[i+1] > '9') {
+			repo = repo[:i] + "/" + repo[i+1:]
+		}
+	}
+	return repo
+}
+
+// cloneRepo makes a shallow clone of spec.Ref into a new temporary directory.
+// The caller removes the directory once done with it.
+func cloneRepo(ctx context.Context, spec *repoSpec, cred *credentials) (string, error) {
+	dir, err := ioutil.TempDir("", "kustomize-observer-")
+	if err != nil {
+		return "", err
+	}
+	ref := spec.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+	for _, args := range [][]string{
+		{"init", "--quiet"},
+		{"remote", "add", "--", "origin", spec.CloneURL},
+		{"fetch", "--quiet", "--depth=1", "--end-of-options", "origin", ref},
+		{"checkout", "--quiet", "FETCH_HEAD"},
+	} {
+		if err := runGit(ctx, dir, cred, args...); err != nil {
+			os.RemoveAll(dir)
+			return "", fmt.Errorf("cloning %s: %v", spec.CloneURL, err)
+		}
+	}
+	return dir, nil
+}
+
+func runGit(ctx context.Context, dir string, cred *credentials, args ...string) error {
+	_, err := gitOutput(ctx, dir, cred, args...)
+	return err
+}
+
+// gitOutput runs git in dir with cred and returns its standard output. When
+// ctx is done git is killed together with the helpers it started, such as
+// ssh and git-remote-https, which would otherwise keep the fetch alive.
+func gitOutput(ctx context.Context, dir string, cred *credentials, args ...string) (string, error) {
+	// An empty credential.helper resets the configured helpers, so the
+	// password is neither looked up in nor stored to the user's keychain.
+	cmd := exec.Command("git", append([]string{"-c", "credential.helper="}, args...)...)
+	cmd.Dir = dir
+	env, err := cred.env()
+	if err != nil {
+		return "", err
+	}
+	cmd.Env = append(append(os.Environ(), "GIT_TERMINAL_PROMPT=0"), env...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(cmd)
+		case <-done:
+		}
+	}()
+	err = cmd.Wait()
+	close(done)
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			return "", err
+		}
+		return "", fmt.Errorf("%v: %s", err, msg)
+	}
+	return stdout.String(), nil
+}
+
+// AskPass answers git's username and password prompts, or ssh's passphrase
+// prompt, when the observer is started as GIT_ASKPASS or SSH_ASKPASS by
+// runGit. It reports whether it handled the call.
+func AskPass(args []string, out io.Writer) bool {
+	if os.Getenv(askPassEnv) == "" {
+		return false
+	}
+	prompt := strings.Join(args, " ")
+	if strings.HasPrefix(strings.ToLower(prompt), "username") {
+		fmt.Fprintln(out, os.Getenv(askUsernameEnv))
+	} else {
+		fmt.Fprintln(out, os.Getenv(askPasswordEnv))
+	}
+	return true
+}
+
+// SSHKeys lists the private keys in ~/.ssh for the build form's key picker.
+func SSHKeys(c echo.Context) error {
+	if !LocalFiles {
+		return c.JSON(http.StatusForbidden, errSSHKeys.Error())
+	}
+	keys := []string{}
+	dir, err := expandHome("~/.ssh")
+	if err != nil {
+		return c.JSON(http.StatusOK, keys)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	for _, fi := range files {
+		if fi.IsDir() || strings.HasSuffix(fi.Name(), ".pub") {
+			continue
+		}
+		path := filepath.Join(dir, fi.Name())
+		head := make([]byte, 64)
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		n, _ := f.Read(head)
+		f.Close()
+		if bytes.Contains(head[:n], []byte("PRIVATE KEY")) {
+			keys = append(keys, path)
+		}
+	}
+	return c.JSON(http.StatusOK, keys)
+}
+
+func expandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, path[1:]), nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// A password in user:pass@ and a bare token used as the url user name.
+var (
+	urlPassword = regexp.MustCompile(`(://[^/@\s:]*):[^/@\s]+@`)
+	urlToken    = regexp.MustCompile(`://[^/@\s:]{20,}@`)
+)
+
+// scrubError removes the given secrets and any credential-looking url part
+// from err, so that a failed clone never echoes them to the UI or logs.
+func scrubError(err error, secrets ...string) error {
+	if err == nil {
+		return nil
+	}
+	msg := urlPassword.ReplaceAllString(err.Error(), "${1}:***@")
+	msg = urlToken.ReplaceAllString(msg, "://***@")
+	for _, s := range secrets {
+		if s != "" {
+			msg = strings.Replace(msg, s, "***", -1)
+		}
+	}
+	if msg == err.Error() {
+		// keep errors such as errExecPlugins comparable
+		return err
+	}
+	return fmt.Errorf("%s", msg)
+}
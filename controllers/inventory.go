@@ -0,0 +1,124 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/kustomize/api/k8sdeps/kunstruct"
+	"sigs.k8s.io/kustomize/api/resmap"
+	"sigs.k8s.io/kustomize/api/resource"
+)
+
+// inventoryAnnotation holds, on the inventory ConfigMap of a build with the
+// prune option, the objects the build is made of. An apply with pruning
+// deletes what the inventory on the cluster lists and the new one doesn't.
+const inventoryAnnotation = "kustomize.config.k8s.io/Inventory"
+
+var errNoInventory = errors.New("pruning needs an inventory object: build with the prune option from a kustomization with an inventory field")
+
+type inventory struct {
+	Current []resourceInfo `json:"current"`
+}
+
+// addInventory appends the inventory ConfigMap asked for by the
+// kustomization in dir to m. kustomize still accepts DoPrune but no longer
+// builds the object itself. A kustomization without an inventory field gets
+// none.
+func addInventory(dir string, m resmap.ResMap) error {
+	k, _, err := readKustomization(dir)
+	if err != nil || k.Inventory == nil {
+		return nil
+	}
+	if k.Inventory.Type != "" && k.Inventory.Type != "ConfigMap" {
+		return fmt.Errorf("inventory type %q is not supported, only ConfigMap", k.Inventory.Type)
+	}
+	if k.Inventory.ConfigMap.Name == "" {
+		return errMissing("inventory.configMap.name")
+	}
+	content, err := json.Marshal(inventory{Current: resourceList(m)})
+	if err != nil {
+		return err
+	}
+	metadata := map[string]interface{}{
+		"name":        k.Inventory.ConfigMap.Name,
+		"annotations": map[string]interface{}{inventoryAnnotation: string(content)},
+	}
+	if k.Inventory.ConfigMap.Namespace != "" {
+		metadata["namespace"] = k.Inventory.ConfigMap.Namespace
+	}
+	rf := resource.NewFactory(kunstruct.NewKunstructuredFactoryImpl())
+	return m.Append(rf.FromMap(map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata":   metadata,
+	}))
+}
+
+// findInventory returns the inventory object among objs, or nil.
+func findInventory(objs []*unstructured.Unstructured) (*unstructured.Unstructured, *inventory, error) {
+	for _, obj := range objs {
+		if obj.GetKind() != "ConfigMap" {
+			continue
+		}
+		if content, ok := obj.GetAnnotations()[inventoryAnnotation]; ok {
+			inv := new(inventory)
+			if err := json.Unmarshal([]byte(content), inv); err != nil {
+				return nil, nil, fmt.Errorf("inventory %s: %v", obj.GetName(), err)
+			}
+			return obj, inv, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+// liveInventory reads the inventory that the last apply left on the
+// cluster. It is empty before the first apply with pruning.
+func (cl *clusterClient) liveInventory(obj *unstructured.Unstructured) (*inventory, error) {
+	ri, err := cl.resourceFor(obj)
+	if err != nil {
+		return nil, err
+	}
+	live, err := ri.Get(obj.GetName(), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return new(inventory), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, inv, err := findInventory([]*unstructured.Unstructured{live})
+	if err != nil {
+		return nil, err
+	}
+	if inv == nil {
+		return nil, fmt.Errorf("ConfigMap %s exists but is not an inventory", live.GetName())
+	}
+	return inv, nil
+}
+
+// pruned lists the objects of prev that are not in cur. Objects are the
+// same when their group, kind, namespace and name are, whatever the version.
+func pruned(prev, cur *inventory) []resourceInfo {
+	key := func(r resourceInfo) string {
+		group := ""
+		if i := strings.Index(r.APIVersion, "/"); i >= 0 {
+			group = r.APIVersion[:i]
+		}
+		return strings.Join([]string{group, r.Kind, r.Namespace, r.Name}, "|")
+	}
+	keep := make(map[string]bool, len(cur.Current))
+	for _, r := range cur.Current {
+		keep[key(r)] = true
+	}
+	var gone []resourceInfo
+	for _, r := range prev.Current {
+		if !keep[key(r)] {
+			gone = append(gone, r)
+		}
+	}
+	return gone
+}
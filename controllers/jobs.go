@@ -0,0 +1,371 @@
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"sigs.k8s.io/kustomize/api/konfig"
+	"sigs.k8s.io/kustomize/api/types"
+	"sigs.k8s.io/yaml"
+)
+
+// Stages a build goes through, in order, as reported in jobEvent.Stage.
+// kustomize loads the kustomization and runs its generators and
+// transformers in a single call, so that is one stageBuilding.
+const (
+	stageQueued    = "queued"
+	stageResolving = "resolving"
+	stageCloning   = "cloning"
+	stageBuilding  = "building"
+	stageDone      = "done"
+)
+
+// Values of job.State.
+const (
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	jobCanceled  = "canceled"
+)
+
+// jobRetention is how long a finished job can still be fetched.
+var jobRetention = 10 * time.Minute
+
+// MaxJobs bounds the jobs building at once and MaxRetainedJobs those kept
+// in memory, running or finished. Past either, StartJob answers 429; the
+// oldest finished job is dropped early to make room before that.
+var (
+	MaxJobs         = 4
+	MaxRetainedJobs = 100
+)
+
+var errTooManyJobs = errors.New("too many builds, try again later")
+
+type jobEvent struct {
+	ID      int       `json:"id"`
+	Stage   string    `json:"stage"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// job is a build running in the background. The kustType it was started
+// with holds the credentials and is never sent back.
+type job struct {
+	ID      string         `json:"id"`
+	State   string         `json:"state"`
+	Stage   string         `json:"stage"`
+	Events  []jobEvent     `json:"events,omitempty"`
+	Result  *buildResponse `json:"result,omitempty"`
+	Started time.Time      `json:"started"`
+
+	status int
+	cancel context.CancelFunc
+	// changed is closed and replaced whenever an event is added.
+	changed chan struct{}
+}
+
+var (
+	jobsMu sync.Mutex
+	jobs   = make(map[string]*job)
+	// running counts the jobs in jobs that have not finished.
+	running int
+)
+
+type progressKey struct{}
+
+// withProgress returns a context whose builds report their stages to f.
+func withProgress(ctx context.Context, f func(stage, message string)) context.Context {
+	return context.WithValue(ctx, progressKey{}, f)
+}
+
+// progress reports a build stage to whoever is watching ctx, if anyone.
+func progress(ctx context.Context, stage, format string, args ...interface{}) {
+	if f, ok := ctx.Value(progressKey{}).(func(stage, message string)); ok {
+		f(stage, fmt.Sprintf(format, args...))
+	}
+}
+
+// describeKustomization names the kustomization file in dir with a count of
+// what it pulls in, for the building stage.
+func describeKustomization(dir string) string {
+	k, name, err := readKustomization(dir)
+	switch {
+	case name == "":
+		return dir
+	case err != nil:
+		return name
+	}
+	return fmt.Sprintf("%s: %d resources, %d generators, %d patches, %d transformers", name,
+		len(k.Resources)+len(k.Bases)+len(k.Components),
+		len(k.ConfigMapGenerator)+len(k.SecretGenerator)+len(k.Generators),
+		len(k.Patches)+len(k.PatchesStrategicMerge)+len(k.PatchesJson6902),
+		len(k.Transformers))
+}
+
+// readKustomization reads the kustomization file in dir and returns it with
+// its file name, which is empty if there is none.
+func readKustomization(dir string) (*types.Kustomization, string, error) {
+	for _, name := range konfig.RecognizedKustomizationFileNames() {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		k := new(types.Kustomization)
+		return k, name, yaml.Unmarshal(data, k)
+	}
+	return nil, "", os.ErrNotExist
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// startJob runs k in the background. The build is not tied to the request
+// that started it, only to BuildTimeout and CancelJob.
+func startJob(k *kustType) (*job, error) {
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := buildContext(context.Background())
+	j := &job{ID: id, State: jobRunning, Started: time.Now(), cancel: cancel, changed: make(chan struct{})}
+	j.add(stageQueued, "build queued")
+
+	jobsMu.Lock()
+	if err := reserveJobLocked(); err != nil {
+		jobsMu.Unlock()
+		cancel()
+		return nil, err
+	}
+	jobs[id] = j
+	running++
+	jobsMu.Unlock()
+
+	go func() {
+		defer cancel()
+		resp := newBuildResponse()
+		status := runBuild(withProgress(ctx, j.add), k, resp)
+		resp.DurationMs = since(j.Started)
+		j.finish(status, resp, ctx.Err() == context.Canceled)
+		time.AfterFunc(jobRetention, func() {
+			jobsMu.Lock()
+			delete(jobs, id)
+			jobsMu.Unlock()
+		})
+	}()
+	return j, nil
+}
+
+// reserveJobLocked makes room for one more job or says why there is none.
+func reserveJobLocked() error {
+	if MaxJobs > 0 && running >= MaxJobs {
+		return errTooManyJobs
+	}
+	if MaxRetainedJobs <= 0 || len(jobs) < MaxRetainedJobs {
+		return nil
+	}
+	var oldest *job
+	for _, j := range jobs {
+		if j.State != jobRunning && (oldest == nil || j.Started.Before(oldest.Started)) {
+			oldest = j
+		}
+	}
+	if oldest == nil {
+		return errTooManyJobs
+	}
+	delete(jobs, oldest.ID)
+	return nil
+}
+
+func getJob(id string) *job {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	return jobs[id]
+}
+
+func (j *job) add(stage, message string) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	j.addLocked(stage, message)
+}
+
+func (j *job) addLocked(stage, message string) {
+	j.Stage = stage
+	j.Events = append(j.Events, jobEvent{ID: len(j.Events), Stage: stage, Message: message, Time: time.Now()})
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+func (j *job) finish(status int, resp *buildResponse, canceled bool) {
+	state, message := jobSucceeded, fmt.Sprintf("built %d resources", len(resp.Resources))
+	switch {
+	case canceled:
+		state, message = jobCanceled, errBuildCanceled.Error()
+	case resp.Error != nil:
+		state, message = jobFailed, resp.Error.Message
+	}
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	j.State, j.Result, j.status = state, resp, status
+	running--
+	j.addLocked(stageDone, message)
+}
+
+// snapshot returns the events from index from on, whether the job has
+// finished and a channel that is closed on the next change.
+func (j *job) snapshot(from int) ([]jobEvent, bool, <-chan struct{}) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	var events []jobEvent
+	if from < len(j.Events) {
+		events = append(events, j.Events[from:]...)
+	}
+	return events, j.State != jobRunning, j.changed
+}
+
+// marshal encodes j under jobsMu, so that the response can be written
+// without holding up the builds that report to it.
+func (j *job) marshal() ([]byte, error) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	return json.Marshal(j)
+}
+
+// StartJob starts a build in the background and returns its job, whose
+// progress is streamed by JobEvents.
+func StartJob(c echo.Context) error {
+	start := time.Now()
+	k := new(kustType)
+	if err := bindKust(c, k); err != nil {
+		return c.JSON(http.StatusBadRequest, newBuildResponse().fail(start, errBadRequest, err))
+	}
+	if err := validateBuild(k); err != nil {
+		return c.JSON(http.StatusBadRequest, newBuildResponse().fail(start, errBadRequest, err))
+	}
+	j, err := startJob(k)
+	if err == errTooManyJobs {
+		return c.JSON(http.StatusTooManyRequests, newBuildResponse().fail(start, errTooMany, err))
+	}
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(http.StatusInternalServerError, newBuildResponse().fail(start, errBuildFailed, err))
+	}
+	data, err := j.marshal()
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set(echo.HeaderLocation, strings.TrimSuffix(c.Request().URL.Path, "/")+"/"+j.ID)
+	return c.JSONBlob(http.StatusAccepted, data)
+}
+
+// GetJob returns a job with its events and, once finished, its result.
+func GetJob(c echo.Context) error {
+	j := getJob(c.Param("id"))
+	if j == nil {
+		return c.JSON(http.StatusNotFound, apiError{Code: errNotFound, Message: "no such job"})
+	}
+	data, err := j.marshal()
+	if err != nil {
+		return err
+	}
+	return c.JSONBlob(http.StatusOK, data)
+}
+
+// CancelJob stops a running job. Cancelling a finished job does nothing.
+func CancelJob(c echo.Context) error {
+	j := getJob(c.Param("id"))
+	if j == nil {
+		return c.JSON(http.StatusNotFound, apiError{Code: errNotFound, Message: "no such job"})
+	}
+	j.cancel()
+	return c.NoContent(http.StatusNoContent)
+}
+
+// JobEvents streams a job's progress as Server-Sent Events: a "progress"
+// event per stage, then a "done" event carrying the job without its YAML.
+// A reconnecting EventSource resumes after its Last-Event-ID.
+func JobEvents(c echo.Context) error {
+	j := getJob(c.Param("id"))
+	if j == nil {
+		return c.JSON(http.StatusNotFound, apiError{Code: errNotFound, Message: "no such job"})
+	}
+	next := 0
+	if last, err := strconv.Atoi(c.Request().Header.Get("Last-Event-ID")); err == nil {
+		next = last + 1
+	}
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for {
+		events, finished, changed := j.snapshot(next)
+		for _, ev := range events {
+			data, err := json.Marshal(ev)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "id: %d\nevent: progress\ndata: %s\n\n", ev.ID, data)
+			next = ev.ID + 1
+		}
+		if finished {
+			jobsMu.Lock()
+			summary := *j
+			summary.Events = nil
+			if j.Result != nil {
+				result := *j.Result
+				result.YAML = ""
+				summary.Result = &result
+			}
+			data, err := json.Marshal(summary)
+			jobsMu.Unlock()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "event: done\ndata: %s\n\n", data)
+			w.Flush()
+			return nil
+		}
+		w.Flush()
+		select {
+		case <-changed:
+		case <-c.Request().Context().Done():
+			return nil
+		}
+	}
+}
+
+// JobResult renders a finished job's YAML like HandlerKust does.
+func JobResult(c echo.Context) error {
+	j := getJob(c.Param("id"))
+	if j == nil {
+		return c.JSON(http.StatusNotFound, "no such job")
+	}
+	jobsMu.Lock()
+	state, status, resp := j.State, j.status, j.Result
+	jobsMu.Unlock()
+	switch {
+	case state == jobRunning:
+		return c.JSON(http.StatusConflict, "the build is still running")
+	case resp.Error != nil:
+		return c.JSON(status, resp.Error.Message)
+	}
+	return c.Render(http.StatusOK, "yaml.html", newYAMLPage(resp))
+}
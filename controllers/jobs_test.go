@@ -0,0 +1,173 @@
+package controllers
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestReserveJob(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		maxJobs, maxRetained int
+		states               []string
+		err                  error
+		dropped              string
+	}{
+		{maxJobs: 2, maxRetained: 3, states: []string{jobRunning}},
+		{maxJobs: 1, maxRetained: 3, states: []string{jobRunning}, err: errTooManyJobs},
+		{maxJobs: 0, maxRetained: 0, states: []string{jobRunning, jobRunning, jobRunning}},
+		// the oldest finished job makes room
+		{maxJobs: 2, maxRetained: 3, states: []string{jobSucceeded, jobRunning, jobFailed}, dropped: "0"},
+		{maxJobs: 2, maxRetained: 3, states: []string{jobRunning, jobCanceled, jobFailed}, dropped: "1"},
+		{maxJobs: 3, maxRetained: 2, states: []string{jobRunning, jobRunning}, err: errTooManyJobs},
+	}
+	defer func(m, r int) { MaxJobs, MaxRetainedJobs = m, r }(MaxJobs, MaxRetainedJobs)
+	defer func(j map[string]*job, r int) { jobs, running = j, r }(jobs, running)
+	for i, tt := range tests {
+		MaxJobs, MaxRetainedJobs = tt.maxJobs, tt.maxRetained
+		jobs, running = make(map[string]*job), 0
+		for n, state := range tt.states {
+			id := string(rune('0' + n))
+			jobs[id] = &job{ID: id, State: state, Started: now.Add(time.Duration(n) * time.Second)}
+			if state == jobRunning {
+				running++
+			}
+		}
+		jobsMu.Lock()
+		err := reserveJobLocked()
+		jobsMu.Unlock()
+		if err != tt.err {
+			t.Errorf("%d: reserveJobLocked() = %v, want %v", i, err, tt.err)
+		}
+		want := len(tt.states)
+		if tt.dropped != "" {
+			want--
+			if jobs[tt.dropped] != nil {
+				t.Errorf("%d: job %s kept, want it dropped", i, tt.dropped)
+			}
+		}
+		if len(jobs) != want {
+			t.Errorf("%d: %d jobs kept, want %d", i, len(jobs), want)
+		}
+	}
+}
+
+// waitJob waits for j to finish and returns the stages it went through.
+func waitJob(t *testing.T, j *job) []string {
+	deadline := time.After(10 * time.Second)
+	for {
+		_, finished, changed := j.snapshot(0)
+		if finished {
+			break
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			t.Fatalf("job %s still running after 10s", j.ID)
+		}
+	}
+	events, _, _ := j.snapshot(0)
+	var stages []string
+	for _, ev := range events {
+		if len(stages) == 0 || stages[len(stages)-1] != ev.Stage {
+			stages = append(stages, ev.Stage)
+		}
+	}
+	return stages
+}
+
+func TestJobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, data := range map[string]string{
+		"kustomization.yaml": "resources:\n- cm.yaml\n",
+		"cm.yaml":            "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addr, stop := stalledServer(t)
+	defer stop()
+	stalled := kustType{Protocols: "http", GitPath: addr + "/org/repo"}
+
+	tests := []struct {
+		name    string
+		k       kustType
+		timeout time.Duration
+		cancel  bool
+		state   string
+		status  int
+		stages  []string
+	}{
+		{name: "local build", k: kustType{Source: sourceLocal, LocalPath: dir},
+			state: jobSucceeded, status: http.StatusOK, stages: []string{stageQueued, stageBuilding, stageDone}},
+		{name: "timeout", k: stalled, timeout: 200 * time.Millisecond,
+			state: jobFailed, status: http.StatusGatewayTimeout, stages: []string{stageQueued, stageResolving, stageDone}},
+		{name: "cancel", k: stalled, cancel: true,
+			state: jobCanceled, status: http.StatusServiceUnavailable, stages: []string{stageQueued, stageResolving, stageDone}},
+	}
+	defer func(l bool, d time.Duration) { LocalFiles, BuildTimeout = l, d }(LocalFiles, BuildTimeout)
+	defer func(d time.Duration) { jobRetention = d }(jobRetention)
+	LocalFiles, jobRetention = true, 100*time.Millisecond
+	e := echo.New()
+	for _, tt := range tests {
+		BuildTimeout = tt.timeout
+		k := tt.k
+		j, err := startJob(&k)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if tt.cancel {
+			// cancel once git is waiting on the server
+			for {
+				events, _, changed := j.snapshot(0)
+				if events[len(events)-1].Stage != stageQueued {
+					break
+				}
+				<-changed
+			}
+			rec := httptest.NewRecorder()
+			c := e.NewContext(httptest.NewRequest(http.MethodDelete, "/api/v1/jobs/"+j.ID, nil), rec)
+			c.SetParamNames("id")
+			c.SetParamValues(j.ID)
+			if err := CancelJob(c); err != nil || rec.Code != http.StatusNoContent {
+				t.Errorf("%s: CancelJob() = %d, %v", tt.name, rec.Code, err)
+			}
+		}
+		stages := waitJob(t, j)
+		jobsMu.Lock()
+		state, status := j.State, j.status
+		jobsMu.Unlock()
+		if state != tt.state || (tt.status != 0 && status != tt.status) {
+			t.Errorf("%s: job %s with status %d, want %s with %d", tt.name, state, status, tt.state, tt.status)
+		}
+		if !reflect.DeepEqual(stages, tt.stages) {
+			t.Errorf("%s: stages %v, want %v", tt.name, stages, tt.stages)
+		}
+	}
+
+	jobsMu.Lock()
+	if running != 0 {
+		t.Errorf("%d jobs still counted as running", running)
+	}
+	jobsMu.Unlock()
+	// finished jobs are dropped after jobRetention
+	time.Sleep(300 * time.Millisecond)
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	if len(jobs) != 0 {
+		t.Errorf("%d jobs kept after they expired", len(jobs))
+	}
+}
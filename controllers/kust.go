@@ -1,24 +1,66 @@
 package controllers
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/gommon/log"
 	"net/http"
 	"os"
-	"os/user"
+	"path/filepath"
 	"sigs.k8s.io/kustomize/api/filesys"
 	"sigs.k8s.io/kustomize/api/krusty"
-	"text/template"
+	"sigs.k8s.io/kustomize/api/resmap"
+	"strings"
+	"time"
+)
+
+// BuildTimeout bounds a single build, zero means no limit.
+var BuildTimeout = 5 * time.Minute
+
+var (
+	errBuildTimeout  = errors.New("build timed out")
+	errBuildCanceled = errors.New("build canceled")
 )
 
 type kustType struct {
-	User      string `json:"username" form:"username" query:"username"`
-	Pass      string `json:"password" form:"password" query:"password"`
-	Protocols string `json:"protocols" form:"protocols" query:"protocols"`
-	GitPath   string `json:"git_path" form:"git_path" query:"git_path"`
+	User          string `json:"username" form:"username" query:"username"`
+	Pass          string `json:"password" form:"password" query:"password"`
+	Protocols     string `json:"protocols" form:"protocols" query:"protocols"`
+	GitPath       string `json:"git_path" form:"git_path" query:"git_path"`
+	Auth          string `json:"auth" form:"auth" query:"auth"`
+	Token         string `json:"token" form:"token" query:"token"`
+	SSHKey        string `json:"ssh_key" form:"ssh_key" query:"ssh_key"`
+	SSHPassphrase string `json:"ssh_passphrase" form:"ssh_passphrase" query:"ssh_passphrase"`
+	Profile       string `json:"profile" form:"profile" query:"profile"`
+	Source        string `json:"source" form:"source" query:"source"`
+	LocalPath     string `json:"local_path" form:"local_path" query:"local_path"`
+	KubeVersion   string `json:"kube_version" form:"kube_version" query:"kube_version"`
+	SkipLint      bool   `json:"skip_lint" form:"skip_lint" query:"skip_lint"`
+	buildOptions
+
+	// cached is set by kRun when the output came from the build cache.
+	cached bool
+	// provenance is set by kRun to where each resource came from.
+	provenance map[resourceInfo]*provenance
 }
 
+// Values of kustType.Source, empty means sourceGit.
+const (
+	sourceGit   = "git"
+	sourceLocal = "local"
+)
+
+// Values of kustType.Auth. An empty Auth is inferred from the fields that
+// are set, so forms that only send username and password keep working.
+const (
+	authNone     = "none"
+	authPassword = "password"
+	authToken    = "token"
+	authSSH      = "ssh"
+)
+
 type generateType struct {
 	AppName        string `json:"appname" form:"appname" query:"appname"`
 	Namespace      string `json:"namespace" form:"namespace" query:"namespace"`
@@ -32,130 +74,208 @@ type generateType struct {
 	Port           string `json:"port" form:"port" query:"port"`
 	TargetPort     string `json:"targetPort" form:"targetPort" query:"targetPort"`
 	PullSecrets    string `json:"pullSecrets" form:"pullSecrets" query:"pullSecrets"`
+	// Pack is the template pack to generate from, see loadPackSource, and
+	// Values the values of its fields.
+	Pack   string            `json:"pack" form:"pack" query:"pack"`
+	Values map[string]string `json:"values" form:"-" query:"-"`
+	// OutputDir is the directory the app directory is created in, empty
+	// for the default, see OutputDir.
+	OutputDir string `json:"output_dir" form:"output_dir" query:"output_dir"`
+	// Environments get one overlay each. None means a uat overlay from the
+	// fields above.
+	Environments []environment `json:"environments" form:"-" query:"-"`
+	// Existing says what to do with files already there, see planScaffold.
+	Existing string `json:"existing" form:"existing" query:"existing"`
+	// Preview only reports what generating would write.
+	Preview bool `json:"preview" form:"preview" query:"preview"`
 }
 
 func HandlerKust(c echo.Context) error {
 	log.Info("Build start")
 	k := new(kustType)
 	// binds the request payload into kustType struct
-	if err := c.Bind(k); err != nil {
+	if err := bindKust(c, k); err != nil {
 		return err
 	}
-	var gitUrl string
-	if k.User != "" {
-		gitUrl = fmt.Sprintf("git::%s://%s:%s@%s", k.Protocols, k.User, k.Pass, k.GitPath)
+	if err := validateBuild(k); err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+	ctx, cancel := buildContext(c.Request().Context())
+	defer cancel()
+	resp := newBuildResponse()
+	status := runBuild(ctx, k, resp)
+	if k.cached {
+		log.Info("Build end, from cache")
 	} else {
-		gitUrl = fmt.Sprintf("git::%s://%s", k.Protocols, k.GitPath)
+		log.Info("Build end")
 	}
-	res, err := kBuild(gitUrl)
-	log.Info("Build end")
-	if err != nil {
-		c.Logger().Error(err)
-		return c.JSON(http.StatusInternalServerError, err.Error())
+	if resp.Error != nil {
+		return c.JSON(status, resp.Error.Message)
 	}
-	return c.Render(http.StatusOK, "yaml.html", string(res[:]))
+	return c.Render(http.StatusOK, "yaml.html", newYAMLPage(resp))
 }
 
-func kBuild(gitUrl string) ([]byte, error) {
-	opts := &krusty.Options{}
-	fSys := filesys.MakeFsOnDisk()
-	k := krusty.MakeKustomizer(fSys, opts)
-	m, err := k.Run(gitUrl)
-	if err != nil {
-		return nil, err
-	}
-	res, err := m.AsYaml()
-	if err != nil {
-		return nil, err
-	}
-	return res, nil
+// bindKust binds the build form into k.
+func bindKust(c echo.Context, k *kustType) error {
+	return bindEmbedded(c, k, &k.buildOptions)
 }
 
-func GenerateKust(c echo.Context) error {
-	log.Info("GenerateKust start")
-	g := new(generateType)
-	if err := c.Bind(g); err != nil {
+// bindEmbedded binds the request into i and then into each of embedded,
+// the structs embedded in i. echo's form binding skips embedded structs of
+// an unexported type, while JSON decoding fills them with i.
+func bindEmbedded(c echo.Context, i interface{}, embedded ...interface{}) error {
+	if err := c.Bind(i); err != nil {
 		return err
 	}
-	path, err := handlerTemplate(g)
-	if err != nil {
-		c.Logger().Error(err)
-		return c.JSON(http.StatusInternalServerError, err.Error())
+	if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEApplicationJSON) {
+		return nil
 	}
-	log.Info("GenerateKust end")
-	return c.JSON(http.StatusOK, path)
+	for _, e := range embedded {
+		if err := c.Bind(e); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func handlerTemplate(g *generateType) (string, error) {
-	desktop := getDesktop()
-	basePath := fmt.Sprintf("%s/%s/base", desktop, g.AppName)
-	overPath := fmt.Sprintf("%s/%s/overlays/uat", desktop, g.AppName)
-	os.MkdirAll(basePath, 0755)
-	os.MkdirAll(overPath, 0755)
-
-	fileMap := make(map[string]string)
-	fileMap["deploy"] = fmt.Sprintf("%s/deployment.yaml", basePath)
-	fileMap["baseKust"] = fmt.Sprintf("%s/kustomization.yaml", basePath)
-	fileMap["service"] = fmt.Sprintf("%s/service.yaml", basePath)
-	fileMap["strategyPatch"] = fmt.Sprintf("%s/strategy_patch.yaml", overPath)
-	fileMap["healthcheckPatch"] = fmt.Sprintf("%s/healthcheck_patch.yaml", overPath)
-	fileMap["memorylimitPatch"] = fmt.Sprintf("%s/memorylimit_patch.yaml", overPath)
-	fileMap["overKust"] = fmt.Sprintf("%s/kustomization.yaml", overPath)
-
-	for key, name := range fileMap {
-		file, err := os.Create(name)
-		if err != nil {
-			return "", err
+// buildContext derives the context of one build from the request's, which
+// is done when the browser aborts the request.
+func buildContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if BuildTimeout > 0 {
+		return context.WithTimeout(parent, BuildTimeout)
+	}
+	return context.WithCancel(parent)
+}
+
+// kRun clones the repo itself rather than handing kustomize a git:: url,
+// which would have to carry the credentials. Cancelling ctx stops git;
+// kustomize itself only works on local files and runs to completion.
+func kRun(ctx context.Context, k *kustType) (resmap.ResMap, error) {
+	var m resmap.ResMap
+	if k.Source == sourceLocal {
+		var err error
+		if m, err = kRunLocal(ctx, k.LocalPath, k.buildOptions); err != nil {
+			return nil, ctxError(ctx, err)
+		}
+	} else {
+		if err := k.applyProfile(); err != nil {
+			return nil, err
+		}
+		if k.Protocols == "" {
+			k.Protocols = "https"
 		}
-		defer file.Close()
-		err = createYaml(key, fileMap, g)
+		cred, err := k.credentials()
 		if err != nil {
-			return "", err
+			return nil, err
 		}
+		if m, err = kRunRemote(ctx, k, cred); err != nil {
+			return nil, ctxError(ctx, scrubError(err, cred.secrets()...))
+		}
+	}
+	var err error
+	k.provenance, err = takeProvenance(m)
+	return m, err
+}
+
+// ctxError reports a build that failed because ctx is done as timed out or
+// canceled, rather than as whatever the killed git process printed.
+func ctxError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return fmt.Errorf("%w after %v", errBuildTimeout, BuildTimeout)
+	case context.Canceled:
+		return errBuildCanceled
 	}
-	resultPath := fmt.Sprintf("%s/%s", desktop, g.AppName)
-	return resultPath, nil
+	return err
 }
 
-func createYaml(name string, fileMap map[string]string, g *generateType) error {
-	var templateName string
-	switch name {
-	case "deploy":
-		templateName = DeployTemplate
-	case "baseKust":
-		templateName = BaseKustTemplate
-	case "service":
-		templateName = SvcTemplate
-	case "strategyPatch":
-		templateName = StrategyTemplate
-	case "healthcheckPatch":
-		templateName = HealthCheckTemplate
-	case "memorylimitPatch":
-		templateName = ResourceTemplate
-	case "overKust":
-		templateName = OverlaysKustTemplate
-	}
-
-	tmpl := template.Must(template.New("tmpl").Parse(templateName))
-	fi, err := os.OpenFile(fileMap[name], os.O_RDWR|os.O_CREATE, 0755)
+func kRunRemote(ctx context.Context, k *kustType, cred *credentials) (resmap.ResMap, error) {
+	spec, err := parseGitPath(k.Protocols, k.GitPath)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	progress(ctx, stageResolving, "resolving %s", spec.CloneURL)
+	sha, err := resolveRef(ctx, spec, cred)
+	if err != nil {
+		return nil, err
+	}
+	if root, err := cacheDir(); err == nil && sha != "" {
+		m, cached, err := kRunCached(ctx, root, spec, sha, cred, k.buildOptions)
+		k.cached = cached
+		return m, err
 	}
-	defer fi.Close()
 
-	err = tmpl.Execute(fi, g)
+	// nothing to key the cache on, build from a throwaway clone
+	progress(ctx, stageCloning, "cloning %s", spec.CloneURL)
+	dir, err := cloneRepo(ctx, spec, cred)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	defer os.RemoveAll(dir)
+	return kustomize(ctx, filepath.Join(dir, filepath.FromSlash(spec.Path)), k.buildOptions)
+}
+
+func kRunLocal(ctx context.Context, path string, o buildOptions) (resmap.ResMap, error) {
+	if !LocalFiles {
+		return nil, errLocalFiles
+	}
+	if path == "" {
+		return nil, errMissing("local_path")
+	}
+	path, err := expandHome(path)
+	if err != nil {
+		return nil, err
+	}
+	return kustomize(ctx, path, o)
+}
+
+func kustomize(ctx context.Context, dir string, o buildOptions) (resmap.ResMap, error) {
+	opts, err := o.krustyOptions()
+	if err != nil {
+		return nil, err
+	}
+	progress(ctx, stageBuilding, "building %s", describeKustomization(dir))
+	fSys := filesys.MakeFsOnDisk()
+	kz := krusty.MakeKustomizer(fSys, opts)
+	m, err := kz.Run(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := annotateProvenance(dir, m); err != nil {
+		log.Warn("tracing provenance: ", err)
+	}
+	if !o.prune() {
+		return m, nil
+	}
+	return m, addInventory(dir, m)
 }
 
-func getDesktop() string {
-	myself, error := user.Current()
-	if error != nil {
-		panic(error)
+func GenerateKust(c echo.Context) error {
+	log.Info("GenerateKust start")
+	g := new(generateType)
+	if err := c.Bind(g); err != nil {
+		return err
+	}
+	if err := g.check(); err != nil {
+		return c.JSON(http.StatusBadRequest, &apiError{Code: errBadRequest, Message: err.Error()})
+	}
+	if g.Preview {
+		plan, err := planScaffold(c.Request().Context(), g)
+		if err != nil {
+			status, code := generateStatus(err)
+			return c.JSON(status, &apiError{Code: code, Message: err.Error()})
+		}
+		return c.JSON(http.StatusOK, plan)
 	}
-	homedir := myself.HomeDir
-	desktop := homedir + "/Desktop"
-	return desktop
+	plan, err := handlerTemplate(c.Request().Context(), g)
+	if err != nil {
+		c.Logger().Error(err)
+		status, code := generateStatus(err)
+		return c.JSON(status, &apiError{Code: code, Message: err.Error()})
+	}
+	log.Info("GenerateKust end")
+	return c.JSON(http.StatusOK, plan.Dir)
 }
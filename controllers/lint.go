@@ -0,0 +1,572 @@
+package controllers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/qri-io/starlib/util"
+	"go.starlark.net/starlark"
+	"sigs.k8s.io/kustomize/api/resmap"
+	"sigs.k8s.io/yaml"
+)
+
+// Severities of lint rules. Findings of severityError fail the CLI.
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+	severityInfo    = "info"
+)
+
+// LintConfig is the file that turns lint rules on and off, changes their
+// severity and adds rules of its own. Empty means lint.yaml in the config
+// directory; a missing file leaves the built-in rules as they are.
+var LintConfig string
+
+type lintFinding struct {
+	resourceInfo
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	Path     string `json:"path"`
+	Message  string `json:"message"`
+}
+
+type lintProblem struct {
+	Path    string
+	Message string
+}
+
+// lintRule checks one resource at a time. The built-in rules, declarative
+// rules and Starlark rules all come down to a check function.
+type lintRule struct {
+	Name     string
+	Severity string
+	check    func(obj map[string]interface{}) ([]lintProblem, error)
+}
+
+// lintConfig is the format of LintConfig:
+//
+//	rules:
+//	  probes: {enabled: false}
+//	  latest-tag: {severity: warning}
+//	custom:
+//	- name: team-label
+//	  kinds: [Deployment, StatefulSet]
+//	  path: metadata.labels.team
+//	  required: true
+//	- name: replicas
+//	  starlark: replicas.star
+type lintConfig struct {
+	Rules  map[string]lintRuleConfig `json:"rules"`
+	Custom []customRule              `json:"custom"`
+}
+
+type lintRuleConfig struct {
+	Enabled  *bool  `json:"enabled"`
+	Severity string `json:"severity"`
+}
+
+// customRule is a user rule. A declarative rule looks at the values found
+// at Path, where "[]" after a field goes through each item of a list and a
+// leading "pod." stands for the pod spec of any workload. A Starlark rule
+// instead names a file, relative to the config, that defines
+// lint(resource) and returns a list of messages or of dicts with path and
+// message.
+type customRule struct {
+	Name      string   `json:"name"`
+	Severity  string   `json:"severity"`
+	Message   string   `json:"message"`
+	Kinds     []string `json:"kinds"`
+	Path      string   `json:"path"`
+	Required  bool     `json:"required"`
+	Forbidden bool     `json:"forbidden"`
+	Pattern   string   `json:"pattern"`
+	Starlark  string   `json:"starlark"`
+}
+
+// builtinRules are the checks reviewers kept doing by hand.
+var builtinRules = []lintRule{
+	{Name: "resource-limits", Severity: severityWarning, check: checkLimits},
+	{Name: "latest-tag", Severity: severityError, check: checkLatestTag},
+	{Name: "pull-policy-always", Severity: severityWarning, check: checkPullPolicy},
+	{Name: "probes", Severity: severityWarning, check: checkProbes},
+	{Name: "privileged", Severity: severityError, check: checkPrivileged},
+}
+
+// Where the pod spec sits in each workload kind.
+var podSpecPaths = map[string][]string{
+	"Pod":                   {"spec"},
+	"Deployment":            {"spec", "template", "spec"},
+	"ReplicaSet":            {"spec", "template", "spec"},
+	"ReplicationController": {"spec", "template", "spec"},
+	"StatefulSet":           {"spec", "template", "spec"},
+	"DaemonSet":             {"spec", "template", "spec"},
+	"Job":                   {"spec", "template", "spec"},
+	"CronJob":               {"spec", "jobTemplate", "spec", "template", "spec"},
+}
+
+func lintConfigPath() (string, error) {
+	if LintConfig != "" {
+		return expandHome(LintConfig)
+	}
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "lint.yaml"), nil
+}
+
+// loadLintRules returns the rules that are enabled, with the severities
+// set in the config.
+func loadLintRules() ([]lintRule, error) {
+	path, err := lintConfigPath()
+	if err != nil {
+		return nil, err
+	}
+	conf := new(lintConfig)
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err) && LintConfig == "":
+	case err != nil:
+		return nil, err
+	default:
+		if err := yaml.UnmarshalStrict(data, conf); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	rules := append([]lintRule(nil), builtinRules...)
+	known := make(map[string]bool)
+	for _, r := range rules {
+		known[r.Name] = true
+	}
+	for _, cr := range conf.Custom {
+		if cr.Name == "" {
+			return nil, fmt.Errorf("%s: %v", path, errMissing("custom rule name"))
+		}
+		if known[cr.Name] {
+			return nil, fmt.Errorf("%s: rule %s is defined twice", path, cr.Name)
+		}
+		r, err := cr.rule(filepath.Dir(path))
+		if err != nil {
+			return nil, fmt.Errorf("%s: rule %s: %v", path, cr.Name, err)
+		}
+		known[cr.Name] = true
+		rules = append(rules, r)
+	}
+
+	enabled := rules[:0]
+	for _, r := range rules {
+		rc, ok := conf.Rules[r.Name]
+		if ok && rc.Severity != "" {
+			r.Severity = rc.Severity
+		}
+		if err := checkSeverity(r.Severity); err != nil {
+			return nil, fmt.Errorf("%s: rule %s: %v", path, r.Name, err)
+		}
+		if !ok || rc.Enabled == nil || *rc.Enabled {
+			enabled = append(enabled, r)
+		}
+	}
+	for name := range conf.Rules {
+		if !known[name] {
+			return nil, fmt.Errorf("%s: unknown rule %s", path, name)
+		}
+	}
+	return enabled, nil
+}
+
+func checkSeverity(s string) error {
+	switch s {
+	case severityError, severityWarning, severityInfo:
+		return nil
+	}
+	return fmt.Errorf("unknown severity %q, want %s, %s or %s", s, severityError, severityWarning, severityInfo)
+}
+
+// lintResources runs the enabled rules over every resource of m. A rule
+// that fails on a resource is reported as a warning and skipped.
+func lintResources(m resmap.ResMap) ([]lintFinding, []string, error) {
+	rules, err := loadLintRules()
+	if err != nil {
+		return nil, nil, err
+	}
+	found := []lintFinding{}
+	var warnings []string
+	for _, res := range m.Resources() {
+		info := newResourceInfo(res)
+		obj := res.Map()
+		for _, r := range rules {
+			problems, err := r.check(obj)
+			if err != nil {
+				warnings = append(warnings, fmt.Sprintf("lint rule %s failed on %s: %v", r.Name, info, err))
+				continue
+			}
+			for _, p := range problems {
+				found = append(found, lintFinding{resourceInfo: info, Rule: r.Name, Severity: r.Severity, Path: p.Path, Message: p.Message})
+			}
+		}
+	}
+	return found, warnings, nil
+}
+
+// countSeverity returns how many findings have severity s.
+func countSeverity(findings []lintFinding, s string) int {
+	n := 0
+	for _, f := range findings {
+		if f.Severity == s {
+			n++
+		}
+	}
+	return n
+}
+
+// podSpec returns the pod spec of a workload and its path, or nil.
+func podSpec(obj map[string]interface{}) (map[string]interface{}, string) {
+	kind, _ := obj["kind"].(string)
+	keys, ok := podSpecPaths[kind]
+	if !ok {
+		return nil, ""
+	}
+	v, path := obj, ""
+	for _, k := range keys {
+		next, ok := v[k].(map[string]interface{})
+		if !ok {
+			return nil, ""
+		}
+		v, path = next, fieldPath(path, k)
+	}
+	return v, path
+}
+
+type container struct {
+	spec map[string]interface{}
+	path string
+	init bool
+}
+
+// containers lists the containers and init containers of a workload.
+func containers(obj map[string]interface{}) []container {
+	spec, path := podSpec(obj)
+	if spec == nil {
+		return nil
+	}
+	var list []container
+	for _, key := range []string{"initContainers", "containers"} {
+		items, _ := spec[key].([]interface{})
+		for i, item := range items {
+			if c, ok := item.(map[string]interface{}); ok {
+				list = append(list, container{spec: c, path: itemPath(fieldPath(path, key), i, c), init: key == "initContainers"})
+			}
+		}
+	}
+	return list
+}
+
+func (c container) name() string {
+	name, _ := c.spec["name"].(string)
+	return name
+}
+
+func checkLimits(obj map[string]interface{}) ([]lintProblem, error) {
+	var problems []lintProblem
+	for _, c := range containers(obj) {
+		resources, _ := c.spec["resources"].(map[string]interface{})
+		limits, _ := resources["limits"].(map[string]interface{})
+		for _, r := range []string{"cpu", "memory"} {
+			if _, ok := limits[r]; !ok {
+				problems = append(problems, lintProblem{
+					Path:    c.path + ".resources.limits." + r,
+					Message: fmt.Sprintf("container %s has no %s limit", c.name(), r),
+				})
+			}
+		}
+	}
+	return problems, nil
+}
+
+func checkLatestTag(obj map[string]interface{}) ([]lintProblem, error) {
+	var problems []lintProblem
+	for _, c := range containers(obj) {
+		image, _ := c.spec["image"].(string)
+		if image == "" || strings.Contains(image, "@") {
+			continue
+		}
+		tag := ""
+		if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+			tag = image[i+1:]
+		}
+		switch tag {
+		case "":
+			problems = append(problems, lintProblem{Path: c.path + ".image", Message: fmt.Sprintf("image %s has no tag", image)})
+		case "latest":
+			problems = append(problems, lintProblem{Path: c.path + ".image", Message: fmt.Sprintf("image %s uses the latest tag", image)})
+		}
+	}
+	return problems, nil
+}
+
+func checkPullPolicy(obj map[string]interface{}) ([]lintProblem, error) {
+	var problems []lintProblem
+	for _, c := range containers(obj) {
+		if c.spec["imagePullPolicy"] == "Always" {
+			problems = append(problems, lintProblem{
+				Path:    c.path + ".imagePullPolicy",
+				Message: fmt.Sprintf("container %s pulls its image on every start", c.name()),
+			})
+		}
+	}
+	return problems, nil
+}
+
+// checkProbes skips Jobs and CronJobs, whose pods are meant to exit, and
+// init containers, which can't have probes.
+func checkProbes(obj map[string]interface{}) ([]lintProblem, error) {
+	if kind := obj["kind"]; kind == "Job" || kind == "CronJob" {
+		return nil, nil
+	}
+	var problems []lintProblem
+	for _, c := range containers(obj) {
+		if c.init {
+			continue
+		}
+		for _, probe := range []string{"livenessProbe", "readinessProbe"} {
+			if _, ok := c.spec[probe]; !ok {
+				problems = append(problems, lintProblem{
+					Path:    c.path + "." + probe,
+					Message: fmt.Sprintf("container %s has no %s", c.name(), probe),
+				})
+			}
+		}
+	}
+	return problems, nil
+}
+
+func checkPrivileged(obj map[string]interface{}) ([]lintProblem, error) {
+	var problems []lintProblem
+	for _, c := range containers(obj) {
+		sc, _ := c.spec["securityContext"].(map[string]interface{})
+		if sc["privileged"] == true {
+			problems = append(problems, lintProblem{
+				Path:    c.path + ".securityContext.privileged",
+				Message: fmt.Sprintf("container %s runs privileged", c.name()),
+			})
+		}
+	}
+	return problems, nil
+}
+
+// rule turns cr into a lintRule, reading Starlark files from dir.
+func (cr customRule) rule(dir string) (lintRule, error) {
+	r := lintRule{Name: cr.Name, Severity: cr.Severity}
+	if r.Severity == "" {
+		r.Severity = severityWarning
+	}
+	var check func(obj map[string]interface{}) ([]lintProblem, error)
+	switch {
+	case cr.Starlark != "" && cr.Path != "":
+		return r, fmt.Errorf("set either path or starlark")
+	case cr.Starlark != "":
+		file := cr.Starlark
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		var err error
+		if check, err = starlarkCheck(file); err != nil {
+			return r, err
+		}
+	case cr.Path != "":
+		var err error
+		if check, err = cr.declarativeCheck(); err != nil {
+			return r, err
+		}
+	default:
+		return r, errMissing("path or starlark")
+	}
+
+	kinds := make(map[string]bool, len(cr.Kinds))
+	for _, k := range cr.Kinds {
+		kinds[k] = true
+	}
+	r.check = func(obj map[string]interface{}) ([]lintProblem, error) {
+		if kind, _ := obj["kind"].(string); len(kinds) > 0 && !kinds[kind] {
+			return nil, nil
+		}
+		return check(obj)
+	}
+	return r, nil
+}
+
+func (cr customRule) declarativeCheck() (func(obj map[string]interface{}) ([]lintProblem, error), error) {
+	n := 0
+	for _, set := range []bool{cr.Required, cr.Forbidden, cr.Pattern != ""} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return nil, fmt.Errorf("set exactly one of required, forbidden or pattern")
+	}
+	var pattern *regexp.Regexp
+	if cr.Pattern != "" {
+		var err error
+		if pattern, err = regexp.Compile(cr.Pattern); err != nil {
+			return nil, err
+		}
+	}
+	message := func(fallback string) string {
+		if cr.Message != "" {
+			return cr.Message
+		}
+		return fallback
+	}
+	segs := strings.Split(cr.Path, ".")
+	pod := segs[0] == "pod"
+
+	return func(obj map[string]interface{}) ([]lintProblem, error) {
+		var root interface{} = obj
+		at, rest := "", segs
+		if pod {
+			spec, path := podSpec(obj)
+			if spec == nil {
+				return nil, nil
+			}
+			root, at, rest = spec, path, segs[1:]
+		}
+		var problems []lintProblem
+		for _, m := range walkPath(root, at, rest) {
+			switch {
+			case cr.Required && !m.found:
+				problems = append(problems, lintProblem{Path: m.path, Message: message("is required")})
+			case cr.Forbidden && m.found:
+				problems = append(problems, lintProblem{Path: m.path, Message: message("must not be set")})
+			case pattern != nil && m.found:
+				s, err := yamlValue(m.value)
+				if err != nil {
+					return nil, err
+				}
+				if !pattern.MatchString(s) {
+					problems = append(problems, lintProblem{Path: m.path, Message: message(fmt.Sprintf("is %s, which does not match %s", s, cr.Pattern))})
+				}
+			}
+		}
+		return problems, nil
+	}, nil
+}
+
+type pathMatch struct {
+	path  string
+	value interface{}
+	found bool
+}
+
+// walkPath returns what is at segs below v, which is found at path. A
+// missing field is a match that wasn't found; a missing list has no items
+// and so no matches.
+func walkPath(v interface{}, path string, segs []string) []pathMatch {
+	if len(segs) == 0 {
+		return []pathMatch{{path: path, value: v, found: true}}
+	}
+	key := strings.TrimSuffix(segs[0], "[]")
+	list := key != segs[0]
+	m, _ := v.(map[string]interface{})
+	child, ok := m[key]
+	path = fieldPath(path, key)
+	switch {
+	case !ok && list:
+		return nil
+	case !ok:
+		for _, seg := range segs[1:] {
+			path = fieldPath(path, strings.TrimSuffix(seg, "[]"))
+		}
+		return []pathMatch{{path: path}}
+	case !list:
+		return walkPath(child, path, segs[1:])
+	}
+	items, _ := child.([]interface{})
+	var matches []pathMatch
+	for i, item := range items {
+		matches = append(matches, walkPath(item, itemPath(path, i, item), segs[1:])...)
+	}
+	return matches
+}
+
+// starlarkMaxSteps bounds the work of loading a Starlark rule and of each
+// call to it. Starlark has no while loops or recursion, but a for loop over
+// a large enough range runs for practically ever.
+const starlarkMaxSteps = 10000000
+
+// starlarkThread returns a thread that gives up after starlarkMaxSteps.
+func starlarkThread(file string) *starlark.Thread {
+	thread := &starlark.Thread{Name: file}
+	thread.SetMaxExecutionSteps(starlarkMaxSteps)
+	return thread
+}
+
+// starlarkCheck loads the lint function of a Starlark file.
+func starlarkCheck(file string) (func(obj map[string]interface{}) ([]lintProblem, error), error) {
+	src, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	globals, err := starlark.ExecFile(starlarkThread(file), file, src, nil)
+	if err != nil {
+		return nil, err
+	}
+	fn, ok := globals["lint"].(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("%s does not define lint(resource)", file)
+	}
+
+	return func(obj map[string]interface{}) ([]lintProblem, error) {
+		arg, err := util.Marshal(obj)
+		if err != nil {
+			return nil, err
+		}
+		v, err := starlark.Call(starlarkThread(file), fn, starlark.Tuple{arg}, nil)
+		if err != nil {
+			return nil, err
+		}
+		if v == starlark.None {
+			return nil, nil
+		}
+		list, ok := v.(starlark.Indexable)
+		if !ok {
+			return nil, fmt.Errorf("lint returned %s, want a list", v.Type())
+		}
+		var problems []lintProblem
+		for i := 0; i < list.Len(); i++ {
+			switch item := list.Index(i).(type) {
+			case starlark.String:
+				problems = append(problems, lintProblem{Message: string(item)})
+			case *starlark.Dict:
+				var p lintProblem
+				if path, ok, _ := item.Get(starlark.String("path")); ok {
+					p.Path, _ = starlark.AsString(path)
+				}
+				if message, ok, _ := item.Get(starlark.String("message")); ok {
+					p.Message, _ = starlark.AsString(message)
+				}
+				problems = append(problems, p)
+			default:
+				return nil, fmt.Errorf("lint returned a list of %s, want strings or dicts", item.Type())
+			}
+		}
+		return problems, nil
+	}, nil
+}
+
+// sortedFindings orders findings by severity, errors first, keeping the
+// resource order within each severity.
+func sortedFindings(findings []lintFinding) []lintFinding {
+	rank := map[string]int{severityError: 0, severityWarning: 1, severityInfo: 2}
+	sorted := append([]lintFinding(nil), findings...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return rank[sorted[i].Severity] < rank[sorted[j].Severity]
+	})
+	return sorted
+}
@@ -0,0 +1,217 @@
+package controllers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+)
+
+// objOf decodes a single resource the way lint rules see it.
+func objOf(t *testing.T, y string) map[string]interface{} {
+	t.Helper()
+	var obj map[string]interface{}
+	if err := yaml.Unmarshal([]byte(y), &obj); err != nil {
+		t.Fatal(err)
+	}
+	return obj
+}
+
+// problemPaths runs check on obj and returns the paths of its problems.
+func problemPaths(t *testing.T, check func(map[string]interface{}) ([]lintProblem, error), obj map[string]interface{}) []string {
+	t.Helper()
+	problems, err := check(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, p := range problems {
+		paths = append(paths, p.Path)
+	}
+	return paths
+}
+
+const lintDeployment = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  labels:
+    team: payments
+spec:
+  template:
+    spec:
+      initContainers:
+      - name: migrate
+        image: migrate:v1
+        resources:
+          limits: {cpu: 100m, memory: 64Mi}
+      containers:
+      - name: web
+        image: nginx:latest
+        imagePullPolicy: Always
+        resources:
+          limits: {cpu: 500m}
+        readinessProbe:
+          httpGet: {path: /, port: 80}
+      - name: agent
+        image: registry.local:5000/agent
+        securityContext:
+          privileged: true
+        resources:
+          limits: {cpu: 100m, memory: 64Mi}
+        livenessProbe:
+          exec: {command: [true]}
+        readinessProbe:
+          exec: {command: [true]}
+`
+
+func TestBuiltinRules(t *testing.T) {
+	const containers = "spec.template.spec.containers"
+	tests := []struct {
+		check func(map[string]interface{}) ([]lintProblem, error)
+		obj   string
+		want  []string
+	}{
+		{checkLimits, lintDeployment, []string{containers + "[name=web].resources.limits.memory"}},
+		{checkLatestTag, lintDeployment, []string{containers + "[name=web].image", containers + "[name=agent].image"}},
+		{checkPullPolicy, lintDeployment, []string{containers + "[name=web].imagePullPolicy"}},
+		{checkProbes, lintDeployment, []string{containers + "[name=web].livenessProbe"}},
+		{checkPrivileged, lintDeployment, []string{containers + "[name=agent].securityContext.privileged"}},
+		{checkProbes, `apiVersion: batch/v1
+kind: Job
+spec:
+  template:
+    spec:
+      containers:
+      - name: once
+        image: busybox:1.31
+`, nil},
+		{checkLatestTag, `apiVersion: v1
+kind: Pod
+spec:
+  containers:
+  - name: pinned
+    image: nginx@sha256:0123456789abcdef
+`, nil},
+		{checkLimits, `apiVersion: v1
+kind: ConfigMap
+data:
+  image: nginx:latest
+`, nil},
+	}
+	for i, tt := range tests {
+		if got := problemPaths(t, tt.check, objOf(t, tt.obj)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%d: problems at %v, want %v", i, got, tt.want)
+		}
+	}
+}
+
+func TestDeclarativeRule(t *testing.T) {
+	tests := []struct {
+		rule customRule
+		want []string
+	}{
+		{customRule{Name: "team", Path: "metadata.labels.team", Required: true}, nil},
+		{customRule{Name: "owner", Path: "metadata.labels.owner", Required: true}, []string{"metadata.labels.owner"}},
+		{customRule{Name: "owner", Kinds: []string{"StatefulSet"}, Path: "metadata.labels.owner", Required: true}, nil},
+		{customRule{Name: "policy", Path: "pod.containers[].imagePullPolicy", Forbidden: true},
+			[]string{"spec.template.spec.containers[name=web].imagePullPolicy"}},
+		{customRule{Name: "registry", Path: "pod.containers[].image", Pattern: `^registry\.local`},
+			[]string{"spec.template.spec.containers[name=web].image"}},
+		{customRule{Name: "volumes", Path: "pod.volumes[].name", Required: true}, nil},
+	}
+	obj := objOf(t, lintDeployment)
+	for _, tt := range tests {
+		r, err := tt.rule.rule("")
+		if err != nil {
+			t.Errorf("%s: %v", tt.rule.Name, err)
+			continue
+		}
+		if r.Severity != severityWarning {
+			t.Errorf("%s: severity %s, want %s", tt.rule.Name, r.Severity, severityWarning)
+		}
+		if got := problemPaths(t, r.check, obj); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: problems at %v, want %v", tt.rule.Name, got, tt.want)
+		}
+	}
+}
+
+func TestCustomRuleErrors(t *testing.T) {
+	for _, cr := range []customRule{
+		{Name: "none"},
+		{Name: "both", Path: "metadata.name", Starlark: "rule.star"},
+		{Name: "two checks", Path: "metadata.name", Required: true, Forbidden: true},
+		{Name: "no check", Path: "metadata.name"},
+		{Name: "bad pattern", Path: "metadata.name", Pattern: "("},
+	} {
+		if _, err := cr.rule(""); err == nil {
+			t.Errorf("%s: rule() succeeded, want an error", cr.Name)
+		}
+	}
+}
+
+func TestStarlarkRule(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lint-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, src string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(src), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("replicas.star", `
+def lint(r):
+    if r["kind"] != "Deployment":
+        return None
+    if r["spec"].get("replicas", 1) < 2:
+        return [{"path": "spec.replicas", "message": "run at least two replicas"}, "and a PodDisruptionBudget"]
+    return []
+`)
+	write("forever.star", `
+def lint(r):
+    for i in range(1000000000):
+        for j in range(1000000000):
+            pass
+`)
+	write("forever_load.star", `
+def spin():
+    for i in range(1000000000):
+        for j in range(1000000000):
+            pass
+
+spin()
+
+def lint(r):
+    return None
+`)
+
+	r, err := customRule{Name: "replicas", Starlark: "replicas.star"}.rule(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	problems, err := r.check(objOf(t, lintDeployment))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []lintProblem{{Path: "spec.replicas", Message: "run at least two replicas"}, {Message: "and a PodDisruptionBudget"}}
+	if !reflect.DeepEqual(problems, want) {
+		t.Errorf("problems %v, want %v", problems, want)
+	}
+
+	r, err = customRule{Name: "forever", Starlark: "forever.star"}.rule(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.check(objOf(t, lintDeployment)); err == nil || !strings.Contains(err.Error(), "too many steps") {
+		t.Errorf("endless rule returned %v, want it stopped after too many steps", err)
+	}
+	if _, err := (customRule{Name: "forever", Starlark: "forever_load.star"}).rule(dir); err == nil || !strings.Contains(err.Error(), "too many steps") {
+		t.Errorf("endless rule file returned %v, want it stopped after too many steps", err)
+	}
+}
@@ -0,0 +1,165 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"sigs.k8s.io/kustomize/api/filesys"
+	"sigs.k8s.io/kustomize/api/konfig"
+	"sigs.k8s.io/kustomize/api/krusty"
+	"sigs.k8s.io/kustomize/api/types"
+)
+
+// Values of buildOptions.LoadRestrictions, the long forms are the ones
+// kustomize's --load_restrictor flag takes.
+const (
+	loadRootOnly = "rootOnly"
+	loadNone     = "none"
+)
+
+// Values of buildOptions.Plugins, empty means pluginsBuiltin.
+const (
+	pluginsBuiltin  = "builtin"
+	pluginsExec     = "exec"
+	pluginsStarlark = "starlark"
+)
+
+var (
+	errExecPlugins     = errors.New("exec plugins run local code and need local files enabled on this server")
+	errStarlarkPlugins = errors.New("starlark plugins also run container functions and scripts from urls and need local files enabled on this server")
+	errLoadNone        = errors.New("load restrictions none let the kustomization read any file and need local files enabled on this server")
+)
+
+// buildOptions are the krusty.Options of a build. They are embedded without
+// a tag so echo binds their fields from the same form as kustType. A nil or
+// empty field was left out by the caller and is filled in by merge.
+type buildOptions struct {
+	LegacySort       *bool  `json:"legacy_sort" form:"legacy_sort" query:"legacy_sort"`
+	ManagedByLabel   *bool  `json:"managed_by_label" form:"managed_by_label" query:"managed_by_label"`
+	LoadRestrictions string `json:"load_restrictions" form:"load_restrictions" query:"load_restrictions"`
+	Prune            *bool  `json:"prune" form:"prune" query:"prune"`
+	Plugins          string `json:"plugins" form:"plugins" query:"plugins"`
+	PluginRoot       string `json:"plugin_root" form:"plugin_root" query:"plugin_root"`
+}
+
+// defaultBuildOptions are kustomize's own defaults.
+func defaultBuildOptions() buildOptions {
+	d := krusty.MakeDefaultOptions()
+	return buildOptions{
+		LegacySort:       &d.DoLegacyResourceSort,
+		ManagedByLabel:   &d.AddManagedbyLabel,
+		LoadRestrictions: d.LoadRestrictions.String(),
+		Prune:            &d.DoPrune,
+		Plugins:          pluginsBuiltin,
+	}
+}
+
+// merge fills the fields the caller left out of o from defaults, such as a
+// profile's options or defaultBuildOptions, one field at a time.
+func (o buildOptions) merge(defaults buildOptions) buildOptions {
+	if o.LegacySort == nil {
+		o.LegacySort = defaults.LegacySort
+	}
+	if o.ManagedByLabel == nil {
+		o.ManagedByLabel = defaults.ManagedByLabel
+	}
+	if o.LoadRestrictions == "" {
+		o.LoadRestrictions = defaults.LoadRestrictions
+	}
+	if o.Prune == nil {
+		o.Prune = defaults.Prune
+	}
+	if o.Plugins == "" {
+		o.Plugins = defaults.Plugins
+	}
+	if o.PluginRoot == "" {
+		o.PluginRoot = defaults.PluginRoot
+	}
+	return o
+}
+
+// prune reports whether the build adds an inventory object for pruning.
+func (o buildOptions) prune() bool {
+	return o.Prune != nil && *o.Prune
+}
+
+func (o buildOptions) krustyOptions() (*krusty.Options, error) {
+	o = o.merge(defaultBuildOptions())
+	opts := krusty.MakeDefaultOptions()
+	pc, err := o.pluginConfig()
+	if err != nil {
+		return nil, err
+	}
+	opts.PluginConfig = pc
+	opts.DoLegacyResourceSort = *o.LegacySort
+	opts.AddManagedbyLabel = *o.ManagedByLabel
+	opts.DoPrune = *o.Prune
+	switch o.LoadRestrictions {
+	case loadRootOnly, types.LoadRestrictionsRootOnly.String():
+		opts.LoadRestrictions = types.LoadRestrictionsRootOnly
+	case loadNone, types.LoadRestrictionsNone.String():
+		if !LocalFiles {
+			return nil, errLoadNone
+		}
+		opts.LoadRestrictions = types.LoadRestrictionsNone
+	default:
+		return nil, fmt.Errorf("unknown load restrictions %q, want %s or %s", o.LoadRestrictions, loadRootOnly, loadNone)
+	}
+	return opts, nil
+}
+
+// pluginConfig keeps kustomize's builtins-only default unless plugins are
+// opted into. Starlark mode gets no plugin root, so it can't fall back to
+// executables or Go plugins found there, but kustomize runs every function
+// plugin it allows, including docker containers and Starlark scripts
+// fetched by url, so it needs LocalFiles just like exec.
+func (o buildOptions) pluginConfig() (*types.PluginConfig, error) {
+	switch o.Plugins {
+	case "", pluginsBuiltin:
+		return konfig.DisabledPluginConfig(), nil
+	case pluginsStarlark:
+		if !LocalFiles {
+			return nil, errStarlarkPlugins
+		}
+		pc := konfig.MakePluginConfig(types.PluginRestrictionsNone, types.BploUseStaticallyLinked, konfig.NoPluginHomeSentinal)
+		pc.FnpLoadingOptions.EnableStar = true
+		return pc, nil
+	case pluginsExec:
+		if !LocalFiles {
+			return nil, errExecPlugins
+		}
+		root, err := o.pluginRoot()
+		if err != nil {
+			return nil, err
+		}
+		pc := konfig.MakePluginConfig(types.PluginRestrictionsNone, types.BploUseStaticallyLinked, root)
+		pc.FnpLoadingOptions.EnableExec = true
+		pc.FnpLoadingOptions.EnableStar = true
+		return pc, nil
+	}
+	return nil, fmt.Errorf("unknown plugins mode %q, want %s, %s or %s", o.Plugins, pluginsBuiltin, pluginsExec, pluginsStarlark)
+}
+
+// pluginRoot defaults to the directory kustomize itself would use.
+func (o buildOptions) pluginRoot() (string, error) {
+	if o.PluginRoot == "" {
+		return konfig.DefaultAbsPluginHome(filesys.MakeFsOnDisk())
+	}
+	root, err := expandHome(o.PluginRoot)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(root)
+}
+
+// warnings describe options the user should know the risk of.
+func (o buildOptions) warnings() []string {
+	switch o.Plugins {
+	case pluginsExec:
+		return []string{"exec plugins are enabled: the kustomization can run any executable under the plugin root on this machine"}
+	case pluginsStarlark:
+		return []string{"starlark plugins are enabled: the kustomization can also run container functions with docker and scripts from any url"}
+	}
+	return nil
+}
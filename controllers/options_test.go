@@ -0,0 +1,96 @@
+package controllers
+
+import (
+	"testing"
+
+	"sigs.k8s.io/kustomize/api/types"
+)
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func TestKrustyOptions(t *testing.T) {
+	tests := []struct {
+		name       string
+		o          buildOptions
+		localFiles bool
+		sort       bool
+		label      bool
+		prune      bool
+		load       types.LoadRestrictions
+		err        error
+	}{
+		{name: "defaults", sort: true, load: types.LoadRestrictionsRootOnly},
+		{name: "prune and label only",
+			o:    buildOptions{Prune: boolPtr(true), ManagedByLabel: boolPtr(true)},
+			sort: true, label: true, prune: true, load: types.LoadRestrictionsRootOnly},
+		{name: "no legacy sort",
+			o:    buildOptions{LegacySort: boolPtr(false)},
+			load: types.LoadRestrictionsRootOnly},
+		{name: "long form",
+			o:    buildOptions{LoadRestrictions: types.LoadRestrictionsRootOnly.String()},
+			sort: true, load: types.LoadRestrictionsRootOnly},
+		{name: "none with local files",
+			o:          buildOptions{LoadRestrictions: loadNone},
+			localFiles: true, sort: true, load: types.LoadRestrictionsNone},
+		{name: "none without local files",
+			o:   buildOptions{LoadRestrictions: loadNone},
+			err: errLoadNone},
+		{name: "exec without local files",
+			o:   buildOptions{Plugins: pluginsExec},
+			err: errExecPlugins},
+		{name: "starlark without local files",
+			o:   buildOptions{Plugins: pluginsStarlark},
+			err: errStarlarkPlugins},
+		{name: "starlark with local files",
+			o:          buildOptions{Plugins: pluginsStarlark},
+			localFiles: true, sort: true, load: types.LoadRestrictionsRootOnly},
+	}
+	defer func(v bool) { LocalFiles = v }(LocalFiles)
+	for _, tt := range tests {
+		LocalFiles = tt.localFiles
+		opts, err := tt.o.krustyOptions()
+		if err != tt.err {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if opts.DoLegacyResourceSort != tt.sort || opts.AddManagedbyLabel != tt.label ||
+			opts.DoPrune != tt.prune || opts.LoadRestrictions != tt.load {
+			t.Errorf("%s: got sort %v, label %v, prune %v, load %v, want %v, %v, %v, %v", tt.name,
+				opts.DoLegacyResourceSort, opts.AddManagedbyLabel, opts.DoPrune, opts.LoadRestrictions,
+				tt.sort, tt.label, tt.prune, tt.load)
+		}
+	}
+}
+
+func TestKrustyOptionsErrors(t *testing.T) {
+	for _, o := range []buildOptions{
+		{LoadRestrictions: "everything"},
+		{Plugins: "go"},
+	} {
+		if _, err := o.krustyOptions(); err == nil {
+			t.Errorf("krustyOptions(%+v) succeeded, want an error", o)
+		}
+	}
+}
+
+func TestMergeBuildOptions(t *testing.T) {
+	saved := buildOptions{
+		LegacySort:       boolPtr(false),
+		ManagedByLabel:   boolPtr(true),
+		LoadRestrictions: loadNone,
+		Prune:            boolPtr(true),
+		Plugins:          pluginsStarlark,
+	}
+	got := buildOptions{Prune: boolPtr(false), LoadRestrictions: loadRootOnly}.merge(saved)
+	if *got.LegacySort || !*got.ManagedByLabel || got.Plugins != pluginsStarlark {
+		t.Errorf("options left out were not taken from the profile: %+v", got)
+	}
+	if *got.Prune || got.LoadRestrictions != loadRootOnly {
+		t.Errorf("options given were overridden by the profile: %+v", got)
+	}
+}
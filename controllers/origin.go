@@ -0,0 +1,49 @@
+package controllers
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/labstack/echo/v4"
+)
+
+// AllowedHosts, when set, are the only Host headers the server answers, as
+// host:port. The window sets them to its loopback address, so that a page
+// whose domain was rebound to 127.0.0.1 can't pass for the window itself.
+var AllowedHosts []string
+
+// SameOrigin refuses POST, PUT and DELETE requests that a browser sends
+// from a page of another origin, so that a web page the user visits can't
+// build, apply or write files through this server. Clients other than
+// browsers send neither Origin nor Referer and are let through.
+func SameOrigin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		r := c.Request()
+		if len(AllowedHosts) > 0 && !allowedHost(r.Host) {
+			return c.JSON(http.StatusForbidden, apiError{Code: errForbidden, Message: "unknown host " + r.Host})
+		}
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			return next(c)
+		}
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			origin = r.Referer()
+		}
+		if origin != "" {
+			if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+				return c.JSON(http.StatusForbidden, apiError{Code: errForbidden, Message: "cross-origin request refused"})
+			}
+		}
+		return next(c)
+	}
+}
+
+func allowedHost(host string) bool {
+	for _, h := range AllowedHosts {
+		if host == h {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestSameOrigin(t *testing.T) {
+	tests := []struct {
+		method, host, origin, referer string
+		allowed                       []string
+		want                          int
+	}{
+		{method: http.MethodPost, host: "127.0.0.1:1323", want: http.StatusOK},
+		{method: http.MethodPost, host: "127.0.0.1:1323", origin: "http://127.0.0.1:1323", want: http.StatusOK},
+		{method: http.MethodPost, host: "127.0.0.1:1323", origin: "https://evil.example", want: http.StatusForbidden},
+		{method: http.MethodPost, host: "127.0.0.1:1323", origin: "null", want: http.StatusForbidden},
+		{method: http.MethodPost, host: "127.0.0.1:1323", referer: "https://evil.example/page", want: http.StatusForbidden},
+		{method: http.MethodPost, host: "127.0.0.1:1323", referer: "http://127.0.0.1:1323/", want: http.StatusOK},
+		{method: http.MethodDelete, host: "127.0.0.1:1323", origin: "https://evil.example", want: http.StatusForbidden},
+		{method: http.MethodGet, host: "127.0.0.1:1323", origin: "https://evil.example", want: http.StatusOK},
+		// a rebound domain is its own origin, only the host check stops it
+		{method: http.MethodPost, host: "evil.example:1323", origin: "http://evil.example:1323",
+			allowed: []string{"127.0.0.1:1323"}, want: http.StatusForbidden},
+		{method: http.MethodGet, host: "evil.example:1323", allowed: []string{"127.0.0.1:1323"}, want: http.StatusForbidden},
+		{method: http.MethodPost, host: "127.0.0.1:1323", origin: "http://127.0.0.1:1323",
+			allowed: []string{"127.0.0.1:1323"}, want: http.StatusOK},
+	}
+	defer func(v []string) { AllowedHosts = v }(AllowedHosts)
+	e := echo.New()
+	h := SameOrigin(func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+	for i, tt := range tests {
+		AllowedHosts = tt.allowed
+		req := httptest.NewRequest(tt.method, "/api/v1/cluster/apply", nil)
+		req.Host = tt.host
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		if tt.referer != "" {
+			req.Header.Set("Referer", tt.referer)
+		}
+		rec := httptest.NewRecorder()
+		if err := h(e.NewContext(req, rec)); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != tt.want {
+			t.Errorf("%d: %s from %q to %s: status %d, want %d", i, tt.method, tt.origin+tt.referer, tt.host, rec.Code, tt.want)
+		}
+	}
+}
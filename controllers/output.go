@@ -0,0 +1,189 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+// OutputDir is where generate writes scaffolds when the request names no
+// directory. Empty means the one saved in settings.json, else the Desktop
+// when there is one, else the home directory.
+var OutputDir string
+
+const settingsFile = "settings.json"
+
+// errDefaultOutput keeps remote callers of a server from having scaffolds
+// written to its Desktop or home directory, or wherever the UI last saved.
+var errDefaultOutput = fmt.Errorf("generate writes to this machine and needs -output-dir or local files: %w", errLocalFiles)
+
+// settings are the preferences saved from the UI.
+type settings struct {
+	OutputDir string `json:"outputDir,omitempty"`
+}
+
+// Where the output directory came from, see outputDirInfo.
+const (
+	outputFromRequest  = "request"
+	outputFromFlag     = "flag"
+	outputFromSettings = "settings"
+	outputFromDesktop  = "desktop"
+	outputFromHome     = "home"
+)
+
+type outputDirInfo struct {
+	Dir    string `json:"dir"`
+	Source string `json:"source"`
+}
+
+// outputDirError is why a scaffold can't be written where it should go.
+type outputDirError struct {
+	Dir string
+	Err error
+}
+
+func (e *outputDirError) Error() string {
+	if e.Dir == "" {
+		return fmt.Sprintf("no output directory: %v", e.Err)
+	}
+	return fmt.Sprintf("output directory %s: %v", e.Dir, e.Err)
+}
+
+func (e *outputDirError) Unwrap() error {
+	return e.Err
+}
+
+var settingsMu sync.Mutex
+
+func loadSettings() (*settings, error) {
+	s := new(settings)
+	dir, err := configDir()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, settingsFile))
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("%s: %v", settingsFile, err)
+	}
+	return s, nil
+}
+
+func saveSettings(s *settings) error {
+	dir, err := configDir()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, settingsFile), data, 0600)
+}
+
+// resolveOutputDir picks the directory to write a scaffold to: dir if the
+// request names one, else the default. It only has to exist as far as it
+// can be created. Without LocalFiles only OutputDir is written to.
+func resolveOutputDir(dir string) (*outputDirInfo, error) {
+	info := &outputDirInfo{Dir: dir, Source: outputFromRequest}
+	if dir == "" {
+		if !LocalFiles && OutputDir == "" {
+			return nil, errDefaultOutput
+		}
+		var err error
+		if info, err = defaultOutputDir(); err != nil {
+			return nil, err
+		}
+	} else if !LocalFiles {
+		// the server's file system is not the caller's to pick from
+		return nil, errLocalFiles
+	}
+	path, err := expandHome(info.Dir)
+	if err == nil {
+		path, err = filepath.Abs(path)
+	}
+	if err != nil {
+		return nil, &outputDirError{Dir: info.Dir, Err: err}
+	}
+	info.Dir = path
+	if fi, err := os.Stat(path); err == nil && !fi.IsDir() {
+		return nil, &outputDirError{Dir: path, Err: errors.New("not a directory")}
+	}
+	return info, nil
+}
+
+func defaultOutputDir() (*outputDirInfo, error) {
+	if OutputDir != "" {
+		return &outputDirInfo{Dir: OutputDir, Source: outputFromFlag}, nil
+	}
+	settingsMu.Lock()
+	s, err := loadSettings()
+	settingsMu.Unlock()
+	if err != nil {
+		return nil, &outputDirError{Err: err}
+	}
+	if s.OutputDir != "" {
+		return &outputDirInfo{Dir: s.OutputDir, Source: outputFromSettings}, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, &outputDirError{Err: fmt.Errorf("%v, choose an output directory", err)}
+	}
+	desktop := os.Getenv("XDG_DESKTOP_DIR")
+	if desktop == "" {
+		desktop = filepath.Join(home, "Desktop")
+	}
+	if fi, err := os.Stat(desktop); err == nil && fi.IsDir() {
+		return &outputDirInfo{Dir: desktop, Source: outputFromDesktop}, nil
+	}
+	return &outputDirInfo{Dir: home, Source: outputFromHome}, nil
+}
+
+// GetOutputDir tells the generate tab where scaffolds go by default.
+func GetOutputDir(c echo.Context) error {
+	info, err := defaultOutputDir()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, info)
+}
+
+// SaveOutputDir makes ?dir= the default output directory, or with an empty
+// dir goes back to the Desktop or home directory.
+func SaveOutputDir(c echo.Context) error {
+	if !LocalFiles {
+		return c.JSON(http.StatusForbidden, errLocalFiles.Error())
+	}
+	dir := c.FormValue("dir")
+	if dir != "" {
+		info, err := resolveOutputDir(dir)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, err.Error())
+		}
+		dir = info.Dir
+	}
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	s, err := loadSettings()
+	if err == nil {
+		s.OutputDir = dir
+		err = saveSettings(s)
+	}
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, dir)
+}
@@ -0,0 +1,55 @@
+package controllers
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveOutputDir(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	flagDir := filepath.Join(tmp, "flag")
+	reqDir := filepath.Join(tmp, "req")
+
+	tests := []struct {
+		localFiles bool
+		outputDir  string
+		dir        string
+		want       string
+		source     string
+		err        error
+	}{
+		// serve without local files: nothing but -output-dir
+		{dir: "", err: errLocalFiles},
+		{dir: reqDir, err: errLocalFiles},
+		{outputDir: flagDir, dir: "", want: flagDir, source: outputFromFlag},
+		{outputDir: flagDir, dir: reqDir, err: errLocalFiles},
+		// local files: the request picks
+		{localFiles: true, dir: reqDir, want: reqDir, source: outputFromRequest},
+		{localFiles: true, outputDir: flagDir, dir: "", want: flagDir, source: outputFromFlag},
+	}
+	defer func(l bool, o string) { LocalFiles, OutputDir = l, o }(LocalFiles, OutputDir)
+	for i, tt := range tests {
+		LocalFiles, OutputDir = tt.localFiles, tt.outputDir
+		info, err := resolveOutputDir(tt.dir)
+		if tt.err != nil {
+			if !errors.Is(err, tt.err) {
+				t.Errorf("%d: resolveOutputDir(%q) error %v, want %v", i, tt.dir, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: resolveOutputDir(%q): %v", i, tt.dir, err)
+			continue
+		}
+		if info.Dir != tt.want || info.Source != tt.source {
+			t.Errorf("%d: resolveOutputDir(%q) = %s (%s), want %s (%s)", i, tt.dir, info.Dir, info.Source, tt.want, tt.source)
+		}
+	}
+}
@@ -0,0 +1,550 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/labstack/echo/v4"
+	"sigs.k8s.io/yaml"
+)
+
+// PackDir holds template packs, a directory each, that generate can use by
+// name. Empty means the packs directory in the config directory.
+var PackDir string
+
+const (
+	packManifest    = "pack.yaml"
+	defaultPackName = "default"
+)
+
+// Values of packField.Type, empty means fieldText.
+const (
+	fieldText    = "text"
+	fieldNumber  = "number"
+	fieldBoolean = "boolean"
+)
+
+// templatePack is a set of scaffold templates and the form fields they
+// need, as described by the pack.yaml at the root of its directory.
+type templatePack struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Fields      []packField `json:"fields"`
+	Files       []packFile  `json:"files"`
+}
+
+// packField is one input of the generate form. Its value reaches the
+// templates as .Values.<name> and, for the fields of the built-in pack,
+// also as the field of the same name, such as .AppName for appname.
+// Pattern is a regular expression the whole value has to match and Enum,
+// when set, the only values there are. Description is the help text the
+// form shows with the field.
+type packField struct {
+	Name        string   `json:"name"`
+	Label       string   `json:"label,omitempty"`
+	Group       string   `json:"group,omitempty"`
+	Type        string   `json:"type,omitempty"`
+	Default     string   `json:"default,omitempty"`
+	Pattern     string   `json:"pattern,omitempty"`
+	Enum        []string `json:"enum,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Required    bool     `json:"required,omitempty"`
+}
+
+// packFile is one file a pack writes. Path, relative to the app directory,
+// is a template itself; Template is the file in the pack it is rendered
+// from. An Environment file is written once per environment and its path
+// tells them apart with {{ .Env }}.
+type packFile struct {
+	Path        string `json:"path"`
+	Template    string `json:"template"`
+	Environment bool   `json:"environment,omitempty"`
+
+	text string
+}
+
+type packInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+// errGitPacks keeps remote callers of a server from having it fetch
+// templates of their choosing and write what they render to its disk.
+var errGitPacks = fmt.Errorf("template packs from git need local files: %w", errLocalFiles)
+
+var (
+	packName      = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+	packFieldName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	number        = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?$`)
+)
+
+// Patterns of the fields of the built-in pack.
+const (
+	dnsLabelPattern = `[a-z0-9]([-a-z0-9]*[a-z0-9])?`
+	cpuPattern      = `[0-9]+(\.[0-9]+)?m?`
+	memoryPattern   = `[0-9]+(\.[0-9]+)?([KMGTPE]i?|k)?`
+	portPattern     = `[1-9][0-9]{0,4}`
+)
+
+// defaultPack is the scaffold generate has always written, from the
+// templates in template.go.
+var defaultPack = &templatePack{
+	Name:        defaultPackName,
+	Description: "Deployment and Service base with strategy, health check and resource patches per overlay",
+	Fields: []packField{
+		{Name: "appname", Label: "app name", Group: "App", Default: "app", Pattern: dnsLabelPattern, Required: true,
+			Description: "lower case letters, digits and dashes, names the app directory and its resources"},
+		{Name: "namespace", Label: "namespace", Group: "App", Default: "test", Pattern: dnsLabelPattern,
+			Description: "namespace of the uat overlay when there are no environments"},
+		{Name: "image", Label: "image", Group: "App", Default: "registry-vpc.cn-shanghai.aliyuncs.com/keking/xxx:latest", Required: true},
+		{Name: "pullSecrets", Label: "imagePullSecrets", Group: "App", Default: "registry-pull-secret"},
+		{Name: "runShell", Label: "runShell", Group: "App", Default: "java /opt/app-*.jar", Required: true},
+		{Name: "path", Label: "path", Group: "Health check", Default: "/actuator/health", Pattern: `/.*`},
+		{Name: "cpulimits", Label: "limits", Group: "CPU", Default: "1000m", Pattern: cpuPattern, Description: "cores, or millicores with m"},
+		{Name: "cpurequests", Label: "requests", Group: "CPU", Default: "200m", Pattern: cpuPattern, Description: "cores, or millicores with m"},
+		{Name: "memorylimits", Label: "limits", Group: "Memory", Default: "2Gi", Pattern: memoryPattern, Description: "bytes, with a suffix such as Mi or Gi"},
+		{Name: "memoryrequests", Label: "requests", Group: "Memory", Default: "2Gi", Pattern: memoryPattern, Description: "bytes, with a suffix such as Mi or Gi"},
+		{Name: "port", Label: "port", Group: "Service", Type: fieldNumber, Default: "8080", Pattern: portPattern},
+		{Name: "targetPort", Label: "targetPort", Group: "Service", Type: fieldNumber, Default: "8080", Pattern: portPattern},
+	},
+	Files: []packFile{
+		{Path: "base/deployment.yaml", Template: "base/deployment.yaml", text: DeployTemplate},
+		{Path: "base/kustomization.yaml", Template: "base/kustomization.yaml", text: BaseKustTemplate},
+		{Path: "base/service.yaml", Template: "base/service.yaml", text: SvcTemplate},
+		{Path: "overlays/{{ .Env }}/strategy_patch.yaml", Template: "overlay/strategy_patch.yaml", Environment: true, text: StrategyTemplate},
+		{Path: "overlays/{{ .Env }}/healthcheck_patch.yaml", Template: "overlay/healthcheck_patch.yaml", Environment: true, text: HealthCheckTemplate},
+		{Path: "overlays/{{ .Env }}/memorylimit_patch.yaml", Template: "overlay/memorylimit_patch.yaml", Environment: true, text: ResourceTemplate},
+		{Path: "overlays/{{ .Env }}/kustomization.yaml", Template: "overlay/kustomization.yaml", Environment: true, text: OverlaysKustTemplate},
+	},
+}
+
+// packError is why a pack couldn't be loaded or filled in.
+type packError struct {
+	Pack string
+	Err  error
+}
+
+func (e *packError) Error() string {
+	return fmt.Sprintf("template pack %s: %v", e.Pack, e.Err)
+}
+
+func (e *packError) Unwrap() error {
+	return e.Err
+}
+
+// fieldError is a value that doesn't fit the field of the pack it is for.
+type fieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *fieldError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Field, e.Err)
+}
+
+func (e *fieldError) Unwrap() error {
+	return e.Err
+}
+
+// check tells why v isn't a value of f, if it isn't. Empty values are left
+// to the defaults and Required.
+func (f *packField) check(v string) error {
+	if v == "" {
+		return nil
+	}
+	switch f.Type {
+	case fieldNumber:
+		if !number.MatchString(v) {
+			return fmt.Errorf("%q is not a number", v)
+		}
+	case fieldBoolean:
+		if _, err := strconv.ParseBool(v); err != nil {
+			return fmt.Errorf("%q is not true or false", v)
+		}
+	}
+	if len(f.Enum) > 0 {
+		found := false
+		for _, e := range f.Enum {
+			found = found || e == v
+		}
+		if !found {
+			return fmt.Errorf("%q is not one of %s", v, strings.Join(f.Enum, ", "))
+		}
+	}
+	if f.Pattern != "" {
+		// anchored, as the names of patch targets are
+		re, err := regexp.Compile("^(?:" + f.Pattern + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid pattern: %v", err)
+		}
+		if !re.MatchString(v) {
+			return fmt.Errorf("%q doesn't match %s", v, f.Pattern)
+		}
+	}
+	return nil
+}
+
+func packDir() (string, error) {
+	if PackDir != "" {
+		return expandHome(PackDir)
+	}
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "packs"), nil
+}
+
+// isGitPack tells a pack in a git repository, given the way the build form
+// takes git paths, from a name or a local directory.
+func isGitPack(source string) bool {
+	return strings.HasPrefix(source, "git::") || strings.Contains(source, "://") || scpLike.MatchString(source)
+}
+
+// loadPackSource finds the pack generate is asked to use: the built-in one
+// for an empty source, a git path, a directory on this machine or the name
+// of a pack in PackDir.
+func loadPackSource(ctx context.Context, source string) (*templatePack, error) {
+	var p *templatePack
+	var err error
+	switch {
+	case source == "" || source == defaultPackName:
+		// a pack called default in PackDir takes the place of the built-in one
+		var dir string
+		if dir, err = packDir(); err != nil || !exists(filepath.Join(dir, defaultPackName, packManifest)) {
+			return defaultPack, nil
+		}
+		p, err = loadPack(filepath.Join(dir, defaultPackName))
+	case isGitPack(source):
+		if !LocalFiles {
+			return nil, errGitPacks
+		}
+		p, err = loadGitPack(ctx, source)
+	case filepath.IsAbs(source) || strings.HasPrefix(source, ".") || strings.HasPrefix(source, "~"):
+		if !LocalFiles {
+			return nil, errLocalFiles
+		}
+		var dir string
+		if dir, err = expandHome(source); err == nil {
+			p, err = loadPack(dir)
+		}
+	default:
+		if !packName.MatchString(source) {
+			return nil, &packError{Pack: source, Err: fmt.Errorf("invalid pack name")}
+		}
+		var dir string
+		if dir, err = packDir(); err == nil {
+			p, err = loadPack(filepath.Join(dir, source))
+		}
+	}
+	if err != nil {
+		return nil, &packError{Pack: source, Err: scrubError(err)}
+	}
+	return p, nil
+}
+
+// loadGitPack loads a pack from the clone the build cache keeps of its
+// repository, or from a throwaway clone when the ref can't be resolved.
+// Credentials may be part of the url, as in the build form.
+func loadGitPack(ctx context.Context, source string) (*templatePack, error) {
+	k := new(kustType)
+	if err := setGitPath(k, source); err != nil {
+		return nil, err
+	}
+	if k.Protocols == "" {
+		k.Protocols = "https"
+	}
+	cred, err := k.credentials()
+	if err != nil {
+		return nil, err
+	}
+	spec, err := parseGitPath(k.Protocols, k.GitPath)
+	if err != nil {
+		return nil, err
+	}
+	sha, err := resolveRef(ctx, spec, cred)
+	if err != nil {
+		return nil, scrubError(err, cred.secrets()...)
+	}
+	root, err := cacheDir()
+	if err != nil || sha == "" {
+		dir, err := cloneRepo(ctx, spec, cred)
+		if err != nil {
+			return nil, scrubError(err, cred.secrets()...)
+		}
+		defer os.RemoveAll(dir)
+		return loadPack(filepath.Join(dir, filepath.FromSlash(spec.Path)))
+	}
+
+	cacheMu.RLock()
+	defer cacheMu.RUnlock()
+	key := cacheKey(spec.CloneURL, spec.Ref)
+	lock, _ := repoLocks.LoadOrStore(key, make(chan struct{}, 1))
+	select {
+	case lock.(chan struct{}) <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-lock.(chan struct{}) }()
+	dir, err := syncClone(ctx, filepath.Join(root, reposDir, key), spec, sha, cred)
+	if err != nil {
+		return nil, scrubError(err, cred.secrets()...)
+	}
+	return loadPack(filepath.Join(dir, filepath.FromSlash(spec.Path)))
+}
+
+// loadPack reads the manifest of the pack in dir and all its templates.
+func loadPack(dir string) (*templatePack, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, packManifest))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no %s in %s", packManifest, dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	p := new(templatePack)
+	if err := yaml.UnmarshalStrict(data, p); err != nil {
+		return nil, fmt.Errorf("%s: %v", packManifest, err)
+	}
+	if p.Name == "" {
+		p.Name = filepath.Base(dir)
+	}
+
+	seen := make(map[string]bool)
+	for _, f := range p.Fields {
+		if !packFieldName.MatchString(f.Name) {
+			return nil, fmt.Errorf("%s: invalid field name %q", packManifest, f.Name)
+		}
+		if seen[f.Name] {
+			return nil, fmt.Errorf("%s: field %s is declared twice", packManifest, f.Name)
+		}
+		seen[f.Name] = true
+		switch f.Type {
+		case "", fieldText, fieldNumber, fieldBoolean:
+		default:
+			return nil, fmt.Errorf("%s: field %s has unknown type %q, want %s, %s or %s",
+				packManifest, f.Name, f.Type, fieldText, fieldNumber, fieldBoolean)
+		}
+		if f.Pattern != "" {
+			if _, err := regexp.Compile(f.Pattern); err != nil {
+				return nil, fmt.Errorf("%s: field %s: invalid pattern: %v", packManifest, f.Name, err)
+			}
+		}
+		for _, e := range f.Enum {
+			enum := f
+			enum.Enum = nil
+			if err := enum.check(e); err != nil {
+				return nil, fmt.Errorf("%s: field %s: choice %v", packManifest, f.Name, err)
+			}
+		}
+		if err := f.check(f.Default); err != nil {
+			return nil, fmt.Errorf("%s: field %s: default %v", packManifest, f.Name, err)
+		}
+	}
+	if !seen["appname"] {
+		return nil, fmt.Errorf("%s: needs an appname field, it names the app directory", packManifest)
+	}
+	if len(p.Files) == 0 {
+		return nil, fmt.Errorf("%s: lists no files", packManifest)
+	}
+	for i := range p.Files {
+		f := &p.Files[i]
+		if f.Path == "" || f.Template == "" {
+			return nil, fmt.Errorf("%s: %v", packManifest, errMissing("path and template of every file"))
+		}
+		if _, err := template.New("path").Parse(f.Path); err != nil {
+			return nil, fmt.Errorf("%s: path %s: %v", packManifest, f.Path, err)
+		}
+		name := path.Clean("/" + filepath.ToSlash(f.Template))
+		text, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := template.New(f.Template).Parse(string(text)); err != nil {
+			return nil, err
+		}
+		f.text = string(text)
+	}
+	return p, nil
+}
+
+// listPacks lists the built-in pack and those in PackDir.
+func listPacks() ([]packInfo, error) {
+	list := []packInfo{{Name: defaultPack.Name, Description: defaultPack.Description}}
+	dir, err := packDir()
+	if err != nil {
+		return nil, err
+	}
+	if exists(filepath.Join(dir, defaultPackName, packManifest)) {
+		if p, err := loadPack(filepath.Join(dir, defaultPackName)); err == nil {
+			list[0].Description = p.Description
+		} else {
+			list[0].Description = err.Error()
+		}
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var names []string
+	for _, fi := range entries {
+		if fi.IsDir() && fi.Name() != defaultPackName && exists(filepath.Join(dir, fi.Name(), packManifest)) {
+			names = append(names, fi.Name())
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		info := packInfo{Name: name}
+		if p, err := loadPack(filepath.Join(dir, name)); err == nil {
+			info.Description = p.Description
+		} else {
+			info.Description = err.Error()
+		}
+		list = append(list, info)
+	}
+	return list, nil
+}
+
+// writePack saves p to dir as a pack.yaml and its templates, which is how
+// a pack of one's own starts out from the built-in one.
+func writePack(dir string, p *templatePack) error {
+	if exists(filepath.Join(dir, packManifest)) {
+		return fmt.Errorf("%s already has a %s", dir, packManifest)
+	}
+	for _, f := range p.Files {
+		name := filepath.Join(dir, filepath.FromSlash(f.Template))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(name, []byte(f.text), 0644); err != nil {
+			return err
+		}
+	}
+	data, err := yaml.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, packManifest), data, 0644)
+}
+
+// fields maps the form names of generateType to its fields, so that packs
+// can ask for them and the built-in templates keep using .AppName and the
+// like.
+func (g *generateType) fields() map[string]*string {
+	return map[string]*string{
+		"appname":        &g.AppName,
+		"namespace":      &g.Namespace,
+		"image":          &g.Image,
+		"runShell":       &g.RunShell,
+		"path":           &g.Path,
+		"cpulimits":      &g.CpuLimits,
+		"cpurequests":    &g.CpuRequests,
+		"memorylimits":   &g.MemoryLimits,
+		"memoryrequests": &g.MemoryRequests,
+		"port":           &g.Port,
+		"targetPort":     &g.TargetPort,
+		"pullSecrets":    &g.PullSecrets,
+	}
+}
+
+// applyPack fills in the value of every field of p: from Values, from the
+// field of g of that name or from the default of the field, and checks it,
+// and the values environments give some of them, against the field.
+func (g *generateType) applyPack(p *templatePack) error {
+	values := make(map[string]string, len(p.Fields))
+	fields := g.fields()
+	schema := make(map[string]*packField, len(p.Fields))
+	for i := range p.Fields {
+		f := &p.Fields[i]
+		schema[f.Name] = f
+		v := g.Values[f.Name]
+		if v == "" && fields[f.Name] != nil {
+			v = *fields[f.Name]
+		}
+		if v == "" {
+			v = f.Default
+		}
+		if v == "" && f.Required {
+			return &fieldError{Field: f.Name, Err: errors.New("a value is required")}
+		}
+		if err := f.check(v); err != nil {
+			return &fieldError{Field: f.Name, Err: err}
+		}
+		values[f.Name] = v
+		if field := fields[f.Name]; field != nil {
+			*field = v
+		}
+	}
+	for name := range g.Values {
+		if schema[name] == nil {
+			return &fieldError{Field: name, Err: fmt.Errorf("not a field of template pack %s", p.Name)}
+		}
+	}
+	// the app name is a directory in the output directory, whatever the
+	// pattern a pack gives it
+	if err := checkDirName(g.AppName); err != nil {
+		return &fieldError{Field: "appname", Err: err}
+	}
+	envs, err := g.environments()
+	if err != nil {
+		return err
+	}
+	for _, env := range envs {
+		for name, v := range map[string]string{
+			"namespace":      env.Namespace,
+			"cpulimits":      env.CpuLimits,
+			"cpurequests":    env.CpuRequests,
+			"memorylimits":   env.MemoryLimits,
+			"memoryrequests": env.MemoryRequests,
+		} {
+			if f := schema[name]; f != nil {
+				if err := f.check(v); err != nil {
+					return &fieldError{Field: name + " of environment " + env.Name, Err: err}
+				}
+			}
+		}
+	}
+	g.Values = values
+	return nil
+}
+
+// checkDirName rejects a name that isn't a single directory name, such as
+// ../.ssh, which would take a path joined with it elsewhere.
+func checkDirName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\:\x00") {
+		return fmt.Errorf("%q is not a directory name", name)
+	}
+	return nil
+}
+
+// ListPacks lists the template packs for the generate tab.
+func ListPacks(c echo.Context) error {
+	list, err := listPacks()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, list)
+}
+
+// GetPack returns the fields and files of ?pack=, which the generate tab
+// builds its form from.
+func GetPack(c echo.Context) error {
+	p, err := loadPackSource(c.Request().Context(), c.QueryParam("pack"))
+	if err != nil {
+		status, _ := generateStatus(err)
+		return c.JSON(status, err.Error())
+	}
+	return c.JSON(http.StatusOK, p)
+}
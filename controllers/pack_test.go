@@ -0,0 +1,109 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestApplyPackDefaultPack(t *testing.T) {
+	g := &generateType{AppName: "web", Port: "80"}
+	if err := g.applyPack(defaultPack); err != nil {
+		t.Fatal(err)
+	}
+	if g.Namespace != "test" || g.TargetPort != "8080" || g.Port != "80" {
+		t.Errorf("fields not filled in from the defaults: %+v", g)
+	}
+	if g.Values["appname"] != "web" || g.Values["cpulimits"] != "1000m" {
+		t.Errorf("values %v", g.Values)
+	}
+}
+
+func TestApplyPack(t *testing.T) {
+	p := &templatePack{
+		Name: "custom",
+		Fields: []packField{
+			{Name: "appname", Required: true},
+			{Name: "namespace", Pattern: dnsLabelPattern},
+			{Name: "replicas", Type: fieldNumber, Default: "2"},
+			{Name: "debug", Type: fieldBoolean},
+			{Name: "tier", Enum: []string{"web", "worker"}},
+			{Name: "owner", Required: true},
+		},
+	}
+	tests := []struct {
+		name   string
+		g      generateType
+		field  string
+		values map[string]string
+	}{
+		{
+			name: "values and defaults",
+			g:    generateType{AppName: "shop", Values: map[string]string{"owner": "payments", "tier": "worker", "debug": "true"}},
+			values: map[string]string{"appname": "shop", "namespace": "", "replicas": "2", "debug": "true",
+				"tier": "worker", "owner": "payments"},
+		},
+		{
+			name:   "values win over fields",
+			g:      generateType{AppName: "shop", Values: map[string]string{"appname": "cart", "owner": "payments"}},
+			values: map[string]string{"appname": "cart", "namespace": "", "replicas": "2", "debug": "", "tier": "", "owner": "payments"},
+		},
+		{name: "required", g: generateType{AppName: "shop"}, field: "owner"},
+		{name: "number", g: generateType{AppName: "shop", Values: map[string]string{"owner": "x", "replicas": "two"}}, field: "replicas"},
+		{name: "boolean", g: generateType{AppName: "shop", Values: map[string]string{"owner": "x", "debug": "yes please"}}, field: "debug"},
+		{name: "enum", g: generateType{AppName: "shop", Values: map[string]string{"owner": "x", "tier": "db"}}, field: "tier"},
+		{name: "pattern", g: generateType{AppName: "shop", Namespace: "Prod", Values: map[string]string{"owner": "x"}}, field: "namespace"},
+		{name: "unknown value", g: generateType{AppName: "shop", Values: map[string]string{"owner": "x", "color": "red"}}, field: "color"},
+		{name: "app name out of the output", g: generateType{AppName: "../../escape", Values: map[string]string{"owner": "x"}}, field: "appname"},
+		{name: "app name from values", g: generateType{Values: map[string]string{"appname": "a/b", "owner": "x"}}, field: "appname"},
+		{
+			name:  "environment",
+			g:     generateType{AppName: "shop", Values: map[string]string{"owner": "x"}, Environments: []environment{{Name: "prod", Namespace: "Prod_1"}}},
+			field: "namespace of environment prod",
+		},
+	}
+	for _, tt := range tests {
+		g := tt.g
+		err := g.applyPack(p)
+		if tt.field == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			} else if !reflect.DeepEqual(g.Values, tt.values) {
+				t.Errorf("%s: values %v, want %v", tt.name, g.Values, tt.values)
+			}
+			continue
+		}
+		var fe *fieldError
+		if !errors.As(err, &fe) || fe.Field != tt.field {
+			t.Errorf("%s: error %v, want one about %s", tt.name, err, tt.field)
+		}
+	}
+}
+
+func TestLoadPackSourceLocalFiles(t *testing.T) {
+	defer func(v bool) { LocalFiles = v }(LocalFiles)
+	LocalFiles = false
+	for _, source := range []string{"git::https://example.com/packs.git//web", "git@example.com:packs.git", "/tmp/packs/web", "./web"} {
+		if _, err := loadPackSource(context.Background(), source); !errors.Is(err, errLocalFiles) {
+			t.Errorf("loadPackSource(%q) = %v, want it refused without local files", source, err)
+		}
+	}
+	if _, err := loadPackSource(context.Background(), "web/../../etc"); err == nil {
+		t.Error("loadPackSource accepted a path as a pack name")
+	}
+}
+
+func TestLoadGitPackOptions(t *testing.T) {
+	defer func(v bool) { LocalFiles = v }(LocalFiles)
+	LocalFiles = true
+	for _, source := range []string{
+		"git::https://example.com/org/packs?ref=--upload-pack=touch /tmp/x;git-upload-pack",
+		"git::file:///etc/org/packs",
+		"git::ssh://-oProxyCommand=touch /tmp/x/org/packs",
+	} {
+		if _, err := loadPackSource(context.Background(), source); err == nil {
+			t.Errorf("loadPackSource(%q) succeeded, want an error", source)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+package controllers
+
+import (
+	"os/exec"
+	"strconv"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills cmd and the processes it started.
+func killProcessGroup(cmd *exec.Cmd) {
+	if exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).Run() != nil {
+		cmd.Process.Kill()
+	}
+}
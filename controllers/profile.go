@@ -0,0 +1,370 @@
+package controllers
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+	"github.com/zalando/go-keyring"
+)
+
+const (
+	appName      = "kustomize-remote-observer"
+	profilesFile = "profiles.json"
+	secretsFile  = "secrets.enc"
+	secretsKey   = "secrets.key"
+)
+
+// Profiles allows saving and listing profiles and building with one, which
+// fills in secrets kept on this machine. The window and the commands always
+// set it, serve mode only when started with -profiles or -local-files.
+var Profiles bool
+
+var errProfiles = errors.New("profiles are disabled on this server")
+
+// profile is a saved connection. Secrets are kept out of profiles.json, in
+// the OS keychain or, where there is none, in an encrypted file.
+type profile struct {
+	Name      string `json:"name" form:"name" query:"name"`
+	Protocols string `json:"protocols" form:"protocols" query:"protocols"`
+	GitPath   string `json:"git_path" form:"git_path" query:"git_path"`
+	Ref       string `json:"ref" form:"ref" query:"ref"`
+	Auth      string `json:"auth" form:"auth" query:"auth"`
+	User      string `json:"username" form:"username" query:"username"`
+	SSHKey    string `json:"ssh_key" form:"ssh_key" query:"ssh_key"`
+	buildOptions
+}
+
+type profileSecrets struct {
+	Pass          string `json:"password,omitempty"`
+	Token         string `json:"token,omitempty"`
+	SSHPassphrase string `json:"ssh_passphrase,omitempty"`
+}
+
+func (s profileSecrets) empty() bool {
+	return s == profileSecrets{}
+}
+
+// profileMu serialises access to profiles.json and the secrets file.
+var profileMu sync.Mutex
+
+// configDir is where the observer keeps its settings.
+func configDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Join(dir, appName)
+	return dir, os.MkdirAll(dir, 0700)
+}
+
+func loadProfiles() (map[string]*profile, error) {
+	profiles := make(map[string]*profile)
+	dir, err := configDir()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, profilesFile))
+	if os.IsNotExist(err) {
+		return profiles, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("%s: %v", profilesFile, err)
+	}
+	return profiles, nil
+}
+
+func saveProfiles(profiles map[string]*profile) error {
+	dir, err := configDir()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(profiles, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, profilesFile), data, 0600)
+}
+
+func getProfile(name string) (*profile, error) {
+	profileMu.Lock()
+	defer profileMu.Unlock()
+	profiles, err := loadProfiles()
+	if err != nil {
+		return nil, err
+	}
+	p, ok := profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("profile %q not found", name)
+	}
+	return p, nil
+}
+
+// applyProfile fills the fields of k left empty by the form from the named
+// profile, including the secrets, which never travel to the browser. The
+// secrets are only filled in when k still points at the profile's repo, so
+// that a caller can't send them to a host of its choosing.
+func (k *kustType) applyProfile() error {
+	if k.Profile == "" {
+		return nil
+	}
+	if !Profiles {
+		return errProfiles
+	}
+	p, err := getProfile(k.Profile)
+	if err != nil {
+		return err
+	}
+	fill := func(dst *string, src string) {
+		if *dst == "" {
+			*dst = src
+		}
+	}
+	fill(&k.Protocols, p.Protocols)
+	fill(&k.GitPath, p.GitPath)
+	fill(&k.Auth, p.Auth)
+	fill(&k.User, p.User)
+	fill(&k.SSHKey, p.SSHKey)
+	if p.Ref != "" && !refQuery.MatchString(k.GitPath) {
+		k.GitPath += "?ref=" + p.Ref
+	}
+	k.buildOptions = k.buildOptions.merge(p.buildOptions)
+
+	if u := cloneURL(k.Protocols, k.GitPath); u == "" || u != cloneURL(p.Protocols, p.GitPath) {
+		return nil
+	}
+
+	profileMu.Lock()
+	s, err := loadSecrets(p.Name)
+	profileMu.Unlock()
+	if err != nil {
+		return err
+	}
+	fill(&k.Pass, s.Pass)
+	fill(&k.Token, s.Token)
+	fill(&k.SSHPassphrase, s.SSHPassphrase)
+	return nil
+}
+
+// ListProfiles returns the saved profiles without their secrets.
+func ListProfiles(c echo.Context) error {
+	profileMu.Lock()
+	profiles, err := loadProfiles()
+	profileMu.Unlock()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+	list := make([]*profile, 0, len(profiles))
+	for _, p := range profiles {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return c.JSON(http.StatusOK, list)
+}
+
+// SaveProfile stores the build form as a named profile. Secrets left empty
+// keep their saved value.
+func SaveProfile(c echo.Context) error {
+	k := new(kustType)
+	if err := bindKust(c, k); err != nil {
+		return err
+	}
+	name := strings.TrimSpace(k.Profile)
+	if name == "" {
+		return c.JSON(http.StatusBadRequest, errMissing("profile").Error())
+	}
+	p := &profile{
+		Name:      name,
+		Protocols: k.Protocols,
+		GitPath:   k.GitPath,
+		Auth:      k.Auth,
+		User:      k.User,
+		SSHKey:    k.SSHKey,
+	}
+	p.buildOptions = k.buildOptions
+	if loc := refQuery.FindStringIndex(k.GitPath); loc != nil {
+		p.GitPath, p.Ref = k.GitPath[:loc[0]], k.GitPath[loc[1]:]
+	}
+
+	profileMu.Lock()
+	defer profileMu.Unlock()
+	profiles, err := loadProfiles()
+	if err == nil {
+		var s profileSecrets
+		s, err = loadSecrets(name)
+		if err == nil {
+			if k.Pass != "" {
+				s.Pass = k.Pass
+			}
+			if k.Token != "" {
+				s.Token = k.Token
+			}
+			if k.SSHPassphrase != "" {
+				s.SSHPassphrase = k.SSHPassphrase
+			}
+			err = saveSecrets(name, s)
+		}
+	}
+	if err == nil {
+		profiles[name] = p
+		err = saveProfiles(profiles)
+	}
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, p)
+}
+
+// DeleteProfile removes a profile and its secrets.
+func DeleteProfile(c echo.Context) error {
+	name := c.Param("name")
+	profileMu.Lock()
+	defer profileMu.Unlock()
+	profiles, err := loadProfiles()
+	if err == nil {
+		delete(profiles, name)
+		err = saveProfiles(profiles)
+	}
+	if err == nil {
+		err = deleteSecrets(name)
+	}
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// loadSecrets reads from the OS keychain first and falls back to the
+// encrypted file when there is no keychain, e.g. Linux without D-Bus.
+func loadSecrets(name string) (profileSecrets, error) {
+	var s profileSecrets
+	data, err := keyring.Get(appName, name)
+	if err == nil {
+		return s, json.Unmarshal([]byte(data), &s)
+	}
+	all, err := loadSecretsFile()
+	if err != nil {
+		return s, err
+	}
+	return all[name], nil
+}
+
+func saveSecrets(name string, s profileSecrets) error {
+	if s.empty() {
+		return deleteSecrets(name)
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if keyring.Set(appName, name, string(data)) == nil {
+		return nil
+	}
+	all, err := loadSecretsFile()
+	if err != nil {
+		return err
+	}
+	all[name] = s
+	return saveSecretsFile(all)
+}
+
+func deleteSecrets(name string) error {
+	keyring.Delete(appName, name)
+	all, err := loadSecretsFile()
+	if err != nil {
+		return err
+	}
+	if _, ok := all[name]; !ok {
+		return nil
+	}
+	delete(all, name)
+	return saveSecretsFile(all)
+}
+
+func loadSecretsFile() (map[string]profileSecrets, error) {
+	all := make(map[string]profileSecrets)
+	dir, err := configDir()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := ioutil.ReadFile(filepath.Join(dir, secretsFile))
+	if os.IsNotExist(err) {
+		return all, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := secretsCipher(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("%s is corrupt", secretsFile)
+	}
+	nonce, sealed := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	data, err := gcm.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", secretsFile, err)
+	}
+	return all, json.Unmarshal(data, &all)
+}
+
+func saveSecretsFile(all map[string]profileSecrets) error {
+	dir, err := configDir()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	gcm, err := secretsCipher(dir)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, secretsFile), gcm.Seal(nonce, nonce, data, nil), 0600)
+}
+
+// secretsCipher uses a random key created on first use and readable by the
+// user only.
+func secretsCipher(dir string) (cipher.AEAD, error) {
+	path := filepath.Join(dir, secretsKey)
+	key, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		key = make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return nil, err
+		}
+		err = ioutil.WriteFile(path, key, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
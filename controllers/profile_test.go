@@ -0,0 +1,21 @@
+package controllers
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestApplyProfileDisabled(t *testing.T) {
+	defer func(v bool) { Profiles = v }(Profiles)
+	Profiles = false
+	k := &kustType{Profile: "prod", GitPath: "github.com/org/repo"}
+	if err := k.applyProfile(); err != errProfiles {
+		t.Errorf("applyProfile() = %v, want %v", err, errProfiles)
+	}
+	if status, _ := buildStatus(errProfiles); status != http.StatusForbidden {
+		t.Errorf("status %d, want %d", status, http.StatusForbidden)
+	}
+	if err := (&kustType{GitPath: "github.com/org/repo"}).applyProfile(); err != nil {
+		t.Errorf("applyProfile() without a profile = %v", err)
+	}
+}
@@ -0,0 +1,466 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"sigs.k8s.io/kustomize/api/k8sdeps/kunstruct"
+	"sigs.k8s.io/kustomize/api/resid"
+	"sigs.k8s.io/kustomize/api/resmap"
+	"sigs.k8s.io/kustomize/api/resource"
+	"sigs.k8s.io/kustomize/api/types"
+)
+
+// provenanceAnnotation carries the provenance of a resource from the build
+// through the render cache. kRun takes it off again before anyone sees it.
+const provenanceAnnotation = "kustomize-remote-observer/provenance"
+
+// provenance is where a resource came from: the file, or generator, that
+// declared it, and what each kustomization on the way up to the one built
+// did to it, in the order kustomize runs its transformers. Paths are
+// relative to the root of the repository.
+type provenance struct {
+	Origin string           `json:"origin"`
+	Steps  []provenanceStep `json:"steps"`
+}
+
+// provenanceStep is one field of a kustomization that changed a resource.
+// MayApply marks a step that may or may not have, such as a transformer
+// plugin, whose config picks its own targets.
+type provenanceStep struct {
+	Kustomization string `json:"kustomization"`
+	Field         string `json:"field"`
+	Detail        string `json:"detail"`
+	MayApply      bool   `json:"mayApply,omitempty"`
+}
+
+// Applied counts the steps known to have changed the resource.
+func (p *provenance) Applied() int {
+	n := 0
+	for _, s := range p.Steps {
+		if !s.MayApply {
+			n++
+		}
+	}
+	return n
+}
+
+type resourceProvenance struct {
+	resourceInfo
+	provenance
+}
+
+// origin is a resource as declared, with the kustomizations that include
+// it, innermost first. A file included twice has one origin per path.
+type origin struct {
+	id     resid.ResId
+	source string
+	chain  []string
+}
+
+// Kinds the replicas field of a kustomization applies to.
+var replicaKinds = map[string]bool{
+	"Deployment":            true,
+	"ReplicaSet":            true,
+	"ReplicationController": true,
+	"StatefulSet":           true,
+}
+
+// hashSuffix is the content hash kustomize appends to the names of the
+// ConfigMaps and Secrets it generates: ten hex digits with 0, 1, 3, a and e
+// swapped for g, h, k, m and t, so that it never spells a word such as
+// monitoring.
+var hashSuffix = regexp.MustCompile(`-[245-9bcdfghkmt]{10}$`)
+
+// repoRoot returns the closest directory above dir with a .git, or dir
+// itself when there is none.
+func repoRoot(dir string) string {
+	for d := dir; ; {
+		if _, err := os.Stat(filepath.Join(d, ".git")); err == nil {
+			return d
+		}
+		parent := filepath.Dir(d)
+		if parent == d {
+			return dir
+		}
+		d = parent
+	}
+}
+
+// annotateProvenance works out the provenance of every resource m built
+// from the kustomization in dir and records it on the resource. Resources
+// it can't trace, such as those of remote bases or generator plugins, get
+// none.
+func annotateProvenance(dir string, m resmap.ResMap) error {
+	root := repoRoot(dir)
+	rel := func(path string) string {
+		if r, err := filepath.Rel(root, path); err == nil {
+			return filepath.ToSlash(r)
+		}
+		return filepath.ToSlash(path)
+	}
+	kusts := make(map[string]*types.Kustomization)
+	origins, err := collectOrigins(dir, nil, kusts, rel)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range m.Resources() {
+		o := findOrigin(r, origins, kusts)
+		if o == nil {
+			continue
+		}
+		p := provenance{Origin: o.source, Steps: []provenanceStep{}}
+		name, ns := o.id.Name, o.id.Namespace
+		for _, d := range o.chain {
+			var steps []provenanceStep
+			steps, name, ns = kustomizationSteps(d, kusts[d], r, o.id, name, ns)
+			for i := range steps {
+				steps[i].Kustomization = rel(d)
+			}
+			p.Steps = append(p.Steps, steps...)
+		}
+		data, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		setAnnotation(r, provenanceAnnotation, string(data))
+	}
+	return nil
+}
+
+// setAnnotation sets or, with an empty value, removes an annotation of r.
+// It works on the map, as GetAnnotations and SetAnnotations give up on, or
+// drop, annotations that the YAML left as other types than strings.
+func setAnnotation(r *resource.Resource, key, value string) {
+	obj := r.Map()
+	meta, ok := obj["metadata"].(map[string]interface{})
+	if !ok {
+		meta = make(map[string]interface{})
+		obj["metadata"] = meta
+	}
+	annotations, _ := meta["annotations"].(map[string]interface{})
+	switch {
+	case value != "" && annotations == nil:
+		meta["annotations"] = map[string]interface{}{key: value}
+	case value != "":
+		annotations[key] = value
+	default:
+		delete(annotations, key)
+		if len(annotations) == 0 {
+			delete(meta, "annotations")
+		}
+	}
+	r.SetMap(obj)
+}
+
+// takeProvenance removes the provenance annotations from m and returns
+// what they said.
+func takeProvenance(m resmap.ResMap) (map[resourceInfo]*provenance, error) {
+	found := make(map[resourceInfo]*provenance)
+	for _, r := range m.Resources() {
+		meta, _ := r.Map()["metadata"].(map[string]interface{})
+		annotations, _ := meta["annotations"].(map[string]interface{})
+		data, ok := annotations[provenanceAnnotation].(string)
+		if !ok {
+			continue
+		}
+		setAnnotation(r, provenanceAnnotation, "")
+		p := new(provenance)
+		if err := json.Unmarshal([]byte(data), p); err != nil {
+			return nil, fmt.Errorf("provenance of %s: %v", newResourceInfo(r), err)
+		}
+		found[newResourceInfo(r)] = p
+	}
+	return found, nil
+}
+
+// collectOrigins lists what the kustomization in dir declares, itself and
+// through its local bases. chain holds the kustomizations that include dir.
+func collectOrigins(dir string, chain []string, kusts map[string]*types.Kustomization, rel func(string) string) ([]origin, error) {
+	for _, d := range chain {
+		if d == dir {
+			return nil, fmt.Errorf("%s includes itself", rel(dir))
+		}
+	}
+	k, name, err := readKustomization(dir)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", rel(dir), err)
+	}
+	kusts[dir] = k
+	chain = append([]string{dir}, chain...)
+
+	var origins []origin
+	var entries []string
+	entries = append(entries, k.Bases...)
+	entries = append(entries, k.Resources...)
+	entries = append(entries, k.Components...)
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry)
+		fi, err := os.Stat(path)
+		if err != nil {
+			// a remote base, kustomize fetched it itself
+			continue
+		}
+		if fi.IsDir() {
+			inner, err := collectOrigins(path, chain, kusts, rel)
+			if err != nil {
+				return nil, err
+			}
+			origins = append(origins, inner...)
+			continue
+		}
+		ids, err := fileIds(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", rel(path), err)
+		}
+		for _, id := range ids {
+			origins = append(origins, origin{id: id, source: rel(path), chain: chain})
+		}
+	}
+
+	source := rel(filepath.Join(dir, name))
+	for _, g := range k.ConfigMapGenerator {
+		id := resid.NewResIdWithNamespace(resid.Gvk{Version: "v1", Kind: "ConfigMap"}, g.Name, g.Namespace)
+		origins = append(origins, origin{id: id, source: source + " configMapGenerator " + g.Name, chain: chain})
+	}
+	for _, g := range k.SecretGenerator {
+		id := resid.NewResIdWithNamespace(resid.Gvk{Version: "v1", Kind: "Secret"}, g.Name, g.Namespace)
+		origins = append(origins, origin{id: id, source: source + " secretGenerator " + g.Name, chain: chain})
+	}
+	return origins, nil
+}
+
+// fileIds returns the ids of the resources in a file, or in a patch.
+func fileIds(path string) ([]resid.ResId, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return yamlIds(data)
+}
+
+func yamlIds(data []byte) ([]resid.ResId, error) {
+	rf := resmap.NewFactory(resource.NewFactory(kunstruct.NewKunstructuredFactoryImpl()), nil)
+	m, err := rf.NewResMapFromBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	var ids []resid.ResId
+	for _, r := range m.Resources() {
+		ids = append(ids, r.OrgId())
+	}
+	return ids, nil
+}
+
+// findOrigin picks the origin of r. Among the paths to the same file, it
+// is the one whose prefixes and suffixes give r its name.
+func findOrigin(r *resource.Resource, origins []origin, kusts map[string]*types.Kustomization) *origin {
+	org := r.OrgId()
+	var candidates []*origin
+	for i := range origins {
+		o := &origins[i]
+		if o.id.Kind == org.Kind && o.id.Group == org.Group && o.id.Name == org.Name {
+			candidates = append(candidates, o)
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return nil
+	case 1:
+		return candidates[0]
+	}
+	name := r.GetName()
+	for _, o := range candidates {
+		n := o.id.Name
+		for _, d := range o.chain {
+			n = kusts[d].NamePrefix + n + kusts[d].NameSuffix
+		}
+		if n == name || n == hashSuffix.ReplaceAllString(name, "") {
+			return o
+		}
+	}
+	return candidates[0]
+}
+
+// kustomizationSteps lists what the kustomization in dir did to r, which
+// was declared as org and is called name in namespace ns when it reaches
+// dir, and returns its name and namespace after dir. Transformer plugins
+// choose their targets in configs of their own and are listed as MayApply.
+func kustomizationSteps(dir string, k *types.Kustomization, r *resource.Resource, org resid.ResId, name, ns string) ([]provenanceStep, string, string) {
+	var steps []provenanceStep
+	add := func(field, detail string) {
+		steps = append(steps, provenanceStep{Field: field, Detail: detail})
+	}
+	named := func(kind, target string) bool {
+		return (kind == "" || kind == org.Kind) && (target == name || target == org.Name)
+	}
+
+	for _, p := range k.PatchesStrategicMerge {
+		if ids, detail := patchIds(dir, string(p)); matchesAny(ids, named) {
+			add("patchesStrategicMerge", detail)
+		}
+	}
+	for _, p := range k.Patches {
+		detail := p.Path
+		if detail == "" {
+			detail = "inline patch"
+		}
+		if p.Target == nil {
+			if ids, _ := patchIds(dir, firstNonEmpty(p.Path, p.Patch)); matchesAny(ids, named) {
+				add("patches", detail)
+			}
+			continue
+		}
+		if selects(p.Target, r, org, name, ns) {
+			add("patches", detail)
+		}
+	}
+	if k.Namespace != "" && r.GetNamespace() != "" && ns != k.Namespace {
+		add("namespace", k.Namespace)
+		ns = k.Namespace
+	}
+	if k.NamePrefix != "" {
+		add("namePrefix", k.NamePrefix)
+	}
+	if k.NameSuffix != "" {
+		add("nameSuffix", k.NameSuffix)
+	}
+	name = k.NamePrefix + name + k.NameSuffix
+	if len(k.CommonLabels) > 0 {
+		add("commonLabels", keyValues(k.CommonLabels))
+	}
+	if len(k.CommonAnnotations) > 0 {
+		add("commonAnnotations", keyValues(k.CommonAnnotations))
+	}
+	for _, p := range k.PatchesJson6902 {
+		if p.Target != nil && named(p.Target.Kind, p.Target.Name) {
+			add("patchesJson6902", firstNonEmpty(p.Path, "inline patch"))
+		}
+	}
+	images := imageNames(r)
+	for _, img := range k.Images {
+		if images[img.Name] || (img.NewName != "" && images[img.NewName]) {
+			add("images", imageDetail(img))
+		}
+	}
+	for _, rep := range k.Replicas {
+		if replicaKinds[org.Kind] && (rep.Name == org.Name || rep.Name == name) {
+			add("replicas", fmt.Sprintf("%s: %d", rep.Name, rep.Count))
+		}
+	}
+	for _, t := range k.Transformers {
+		steps = append(steps, provenanceStep{Field: "transformers", Detail: t, MayApply: true})
+	}
+	return steps, name, ns
+}
+
+// patchIds returns the ids a patch names, read from the file it is in or
+// from the patch itself, and how to call the patch.
+func patchIds(dir, patch string) ([]resid.ResId, string) {
+	if fi, err := os.Stat(filepath.Join(dir, patch)); err == nil && !fi.IsDir() {
+		ids, _ := fileIds(filepath.Join(dir, patch))
+		return ids, patch
+	}
+	ids, _ := yamlIds([]byte(patch))
+	return ids, "inline patch"
+}
+
+func matchesAny(ids []resid.ResId, named func(kind, name string) bool) bool {
+	for _, id := range ids {
+		if named(id.Kind, id.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// selects reports whether the target of a patch picks r. Names are
+// regular expressions, as in kustomize.
+func selects(t *types.Selector, r *resource.Resource, org resid.ResId, name, ns string) bool {
+	if t.Kind != "" && t.Kind != org.Kind {
+		return false
+	}
+	if t.Group != "" && t.Group != org.Group {
+		return false
+	}
+	if t.Namespace != "" && t.Namespace != ns {
+		return false
+	}
+	if t.Name != "" {
+		re, err := regexp.Compile("^(?:" + t.Name + ")$")
+		if err != nil || !(re.MatchString(name) || re.MatchString(org.Name)) {
+			return false
+		}
+	}
+	if t.LabelSelector != "" {
+		if ok, err := r.MatchesLabelSelector(t.LabelSelector); err != nil || !ok {
+			return false
+		}
+	}
+	if t.AnnotationSelector != "" {
+		if ok, err := r.MatchesAnnotationSelector(t.AnnotationSelector); err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// imageNames returns the images r runs, without tags or digests.
+func imageNames(r *resource.Resource) map[string]bool {
+	names := make(map[string]bool)
+	for _, c := range containers(r.Map()) {
+		image, _ := c.spec["image"].(string)
+		names[imageName(image)] = true
+	}
+	return names
+}
+
+// imageName strips the tag and digest off image.
+func imageName(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image
+}
+
+func imageDetail(img types.Image) string {
+	detail := img.Name
+	if img.NewName != "" {
+		detail += " -> " + img.NewName
+	}
+	if img.NewTag != "" {
+		detail += ":" + img.NewTag
+	}
+	if img.Digest != "" {
+		detail += "@" + img.Digest
+	}
+	return detail
+}
+
+func keyValues(m map[string]string) string {
+	pairs := make([]string, 0, len(m))
+	for k, v := range m {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+func firstNonEmpty(s ...string) string {
+	for _, v := range s {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
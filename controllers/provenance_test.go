@@ -0,0 +1,132 @@
+package controllers
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestProvenance(t *testing.T) {
+	root, err := ioutil.TempDir("", "provenance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	files := map[string]string{
+		"base/kustomization.yaml": `resources:
+- deploy.yaml
+- service.yaml
+configMapGenerator:
+- name: app-config
+  literals:
+  - mode=base
+commonLabels:
+  app: app
+`,
+		"base/deploy.yaml": `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+      - name: app
+        image: app:v1
+`,
+		"base/service.yaml": `apiVersion: v1
+kind: Service
+metadata:
+  name: app
+spec:
+  ports:
+  - port: 80
+`,
+		"overlays/prod/kustomization.yaml": `resources:
+- ../../base
+namespace: prod
+namePrefix: prod-
+patchesStrategicMerge:
+- replicas.yaml
+images:
+- name: app
+  newTag: v2
+`,
+		"overlays/prod/replicas.yaml": `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  replicas: 3
+`,
+	}
+	// the repository root, which paths are relative to
+	if err := os.Mkdir(filepath.Join(root, ".git"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const base, prod = "base", "overlays/prod"
+	want := map[string]provenance{
+		"Deployment": {Origin: "base/deploy.yaml", Steps: []provenanceStep{
+			{Kustomization: base, Field: "commonLabels", Detail: "app=app"},
+			{Kustomization: prod, Field: "patchesStrategicMerge", Detail: "replicas.yaml"},
+			{Kustomization: prod, Field: "namespace", Detail: "prod"},
+			{Kustomization: prod, Field: "namePrefix", Detail: "prod-"},
+			{Kustomization: prod, Field: "images", Detail: "app:v2"},
+		}},
+		"Service": {Origin: "base/service.yaml", Steps: []provenanceStep{
+			{Kustomization: base, Field: "commonLabels", Detail: "app=app"},
+			{Kustomization: prod, Field: "namespace", Detail: "prod"},
+			{Kustomization: prod, Field: "namePrefix", Detail: "prod-"},
+		}},
+		"ConfigMap": {Origin: "base/kustomization.yaml configMapGenerator app-config", Steps: []provenanceStep{
+			{Kustomization: base, Field: "commonLabels", Detail: "app=app"},
+			{Kustomization: prod, Field: "namespace", Detail: "prod"},
+			{Kustomization: prod, Field: "namePrefix", Detail: "prod-"},
+		}},
+	}
+
+	m, err := kustomize(context.Background(), filepath.Join(root, "overlays", "prod"), buildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the annotations have to survive the render cache
+	data, err := m.AsYaml()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = resMapOf(t, string(data))
+	found, err := takeProvenance(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]provenance)
+	for r, p := range found {
+		got[r.Kind] = *p
+	}
+	for kind, w := range want {
+		if !reflect.DeepEqual(got[kind], w) {
+			t.Errorf("provenance of the %s:\n got %+v\nwant %+v", kind, got[kind], w)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("provenance of %d resources, want %d", len(got), len(want))
+	}
+	for _, r := range m.Resources() {
+		if _, ok := r.GetAnnotations()[provenanceAnnotation]; ok {
+			t.Errorf("%s kept its provenance annotation", r.CurId())
+		}
+	}
+}
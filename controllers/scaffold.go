@@ -0,0 +1,343 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Values of generateType.Existing, what to do with scaffold files that are
+// already on disk and differ from the new ones. Empty refuses to write.
+const (
+	existingOverwrite = "overwrite"
+	existingSkip      = "skip"
+	existingNew       = "new"
+)
+
+// Values of scaffoldFile.Action.
+const (
+	fileCreate    = "create"
+	fileOverwrite = "overwrite"
+	fileSkip      = "skip"
+	fileUnchanged = "unchanged"
+	fileExists    = "exists"
+)
+
+// scaffoldPlan is what generating writes, or would write: the app
+// directory and every file in it.
+type scaffoldPlan struct {
+	Dir   string         `json:"dir"`
+	Files []scaffoldFile `json:"files"`
+}
+
+// scaffoldFile is one file of a scaffold. Diff shows the lines that change
+// in a file already there.
+type scaffoldFile struct {
+	Path   string `json:"path"`
+	Action string `json:"action"`
+	Diff   string `json:"diff,omitempty"`
+	data   []byte
+}
+
+// existingFilesError is returned when a scaffold would change files that
+// are there and the request doesn't say what to do with them.
+type existingFilesError struct {
+	Dir   string
+	Files []string
+}
+
+func (e *existingFilesError) Error() string {
+	return fmt.Sprintf("%s already has %s, choose %s, %s or %s",
+		e.Dir, strings.Join(e.Files, ", "), existingOverwrite, existingSkip, existingNew)
+}
+
+// environment is one overlay of a scaffold. Fields left empty take the
+// values of the app, the namespace the name of the environment.
+type environment struct {
+	Name           string `json:"name"`
+	Namespace      string `json:"namespace"`
+	Replicas       int    `json:"replicas"`
+	CpuLimits      string `json:"cpulimits"`
+	CpuRequests    string `json:"cpurequests"`
+	MemoryLimits   string `json:"memorylimits"`
+	MemoryRequests string `json:"memoryrequests"`
+	ImageTag       string `json:"imageTag"`
+}
+
+// scaffoldData is what the templates see: the app and the values of the
+// fields of the pack, with those of the environment for the files of an
+// overlay.
+type scaffoldData struct {
+	generateType
+	Env       string
+	Replicas  int
+	ImageName string
+	ImageTag  string
+}
+
+var envName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// environments returns the environments of g with the defaults filled in.
+func (g *generateType) environments() ([]environment, error) {
+	if len(g.Environments) == 0 {
+		return []environment{{Name: "uat", Namespace: firstNonEmpty(g.Namespace, "uat"), Replicas: 1,
+			CpuLimits: g.CpuLimits, CpuRequests: g.CpuRequests,
+			MemoryLimits: g.MemoryLimits, MemoryRequests: g.MemoryRequests}}, nil
+	}
+	envs := make([]environment, 0, len(g.Environments))
+	seen := make(map[string]bool)
+	for _, env := range g.Environments {
+		if !envName.MatchString(env.Name) {
+			return nil, fmt.Errorf("invalid environment name %q", env.Name)
+		}
+		if seen[env.Name] {
+			return nil, fmt.Errorf("environment %s is listed twice", env.Name)
+		}
+		seen[env.Name] = true
+		if env.Replicas < 0 {
+			return nil, fmt.Errorf("environment %s: replicas must not be negative", env.Name)
+		}
+		fill := func(dst *string, src string) {
+			if *dst == "" {
+				*dst = src
+			}
+		}
+		fill(&env.Namespace, env.Name)
+		fill(&env.CpuLimits, g.CpuLimits)
+		fill(&env.CpuRequests, g.CpuRequests)
+		fill(&env.MemoryLimits, g.MemoryLimits)
+		fill(&env.MemoryRequests, g.MemoryRequests)
+		if env.Replicas == 0 {
+			env.Replicas = 1
+		}
+		envs = append(envs, env)
+	}
+	return envs, nil
+}
+
+// renderScaffold renders every file of the scaffold of g from pack p, by
+// path relative to the app directory.
+func renderScaffold(g *generateType, p *templatePack) ([]scaffoldFile, error) {
+	envs, err := g.environments()
+	if err != nil {
+		return nil, err
+	}
+	var files []scaffoldFile
+	seen := make(map[string]bool)
+	render := func(f packFile, data *scaffoldData) error {
+		var name, text bytes.Buffer
+		tmpl, err := template.New("path").Parse(f.Path)
+		if err == nil {
+			err = tmpl.Execute(&name, data)
+		}
+		if err != nil {
+			return &packError{Pack: p.Name, Err: err}
+		}
+		clean := path.Clean(filepath.ToSlash(name.String()))
+		if path.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+			return &packError{Pack: p.Name, Err: fmt.Errorf("path %s leaves the app directory", name.String())}
+		}
+		if seen[clean] {
+			return &packError{Pack: p.Name, Err: fmt.Errorf("writes %s twice", clean)}
+		}
+		seen[clean] = true
+		tmpl, err = template.New(f.Template).Parse(f.text)
+		if err == nil {
+			err = tmpl.Execute(&text, data)
+		}
+		if err != nil {
+			return &packError{Pack: p.Name, Err: err}
+		}
+		files = append(files, scaffoldFile{Path: clean, data: text.Bytes()})
+		return nil
+	}
+
+	base := &scaffoldData{generateType: *g, Replicas: 1, ImageName: imageName(g.Image)}
+	for _, f := range p.Files {
+		if !f.Environment {
+			if err := render(f, base); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, env := range envs {
+		data := &scaffoldData{generateType: *g, Env: env.Name, Replicas: env.Replicas,
+			ImageName: imageName(g.Image), ImageTag: env.ImageTag}
+		data.Values = make(map[string]string, len(g.Values))
+		for k, v := range g.Values {
+			data.Values[k] = v
+		}
+		fields := data.fields()
+		for name, v := range map[string]string{
+			"namespace":      env.Namespace,
+			"cpulimits":      env.CpuLimits,
+			"cpurequests":    env.CpuRequests,
+			"memorylimits":   env.MemoryLimits,
+			"memoryrequests": env.MemoryRequests,
+		} {
+			*fields[name] = v
+			if _, ok := data.Values[name]; ok {
+				data.Values[name] = v
+			}
+		}
+		for _, f := range p.Files {
+			if f.Environment {
+				if err := render(f, data); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return files, nil
+}
+
+// check rejects what g can't be generated from.
+func (g *generateType) check() error {
+	switch g.Existing {
+	case "", existingOverwrite, existingSkip, existingNew:
+	default:
+		return fmt.Errorf("unknown existing %q, want %s, %s or %s", g.Existing, existingOverwrite, existingSkip, existingNew)
+	}
+	_, err := g.environments()
+	return err
+}
+
+// planScaffold renders the scaffold of g and compares it with what is on
+// disk, without touching anything.
+func planScaffold(ctx context.Context, g *generateType) (*scaffoldPlan, error) {
+	if err := g.check(); err != nil {
+		return nil, err
+	}
+	p, err := loadPackSource(ctx, g.Pack)
+	if err != nil {
+		return nil, err
+	}
+	if err := g.applyPack(p); err != nil {
+		return nil, err
+	}
+	out, err := resolveOutputDir(g.OutputDir)
+	if err != nil {
+		return nil, err
+	}
+	plan := &scaffoldPlan{Dir: filepath.Join(out.Dir, g.AppName)}
+	if g.Existing == existingNew {
+		// the first of app, app-2, app-3, ... that isn't there yet
+		base := plan.Dir
+		for n := 2; exists(plan.Dir); n++ {
+			plan.Dir = base + "-" + strconv.Itoa(n)
+		}
+	}
+
+	files, err := renderScaffold(g, p)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		f.Action = fileCreate
+		old, err := ioutil.ReadFile(filepath.Join(plan.Dir, filepath.FromSlash(f.Path)))
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return nil, err
+		case bytes.Equal(old, f.data):
+			f.Action = fileUnchanged
+		default:
+			f.Diff = lineDiff(string(old), string(f.data))
+			switch g.Existing {
+			case existingOverwrite:
+				f.Action = fileOverwrite
+			case existingSkip:
+				f.Action = fileSkip
+			default:
+				f.Action = fileExists
+			}
+		}
+		plan.Files = append(plan.Files, f)
+	}
+	return plan, nil
+}
+
+// handlerTemplate writes the scaffold of g as planScaffold planned it.
+func handlerTemplate(ctx context.Context, g *generateType) (*scaffoldPlan, error) {
+	plan, err := planScaffold(ctx, g)
+	if err != nil {
+		return nil, err
+	}
+	var conflicts []string
+	for _, f := range plan.Files {
+		if f.Action == fileExists {
+			conflicts = append(conflicts, f.Path)
+		}
+	}
+	if len(conflicts) > 0 {
+		return plan, &existingFilesError{Dir: plan.Dir, Files: conflicts}
+	}
+
+	for _, f := range plan.Files {
+		if f.Action != fileCreate && f.Action != fileOverwrite {
+			continue
+		}
+		name := filepath.Join(plan.Dir, filepath.FromSlash(f.Path))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			return nil, &outputDirError{Dir: plan.Dir, Err: err}
+		}
+		if err := ioutil.WriteFile(name, f.data, 0644); err != nil {
+			return nil, err
+		}
+	}
+	return plan, nil
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// lineDiff shows how b differs from a, every line of both prefixed with
+// "-", "+" or " ". Scaffold files are short enough for a plain longest
+// common subsequence.
+func lineDiff(a, b string) string {
+	x := strings.Split(strings.TrimSuffix(a, "\n"), "\n")
+	y := strings.Split(strings.TrimSuffix(b, "\n"), "\n")
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var sb strings.Builder
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			sb.WriteString(" " + x[i] + "\n")
+			i++
+			j++
+		case j == len(y) || (i < len(x) && lcs[i+1][j] >= lcs[i][j+1]):
+			sb.WriteString("-" + x[i] + "\n")
+			i++
+		default:
+			sb.WriteString("+" + y[j] + "\n")
+			j++
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,123 @@
+package controllers
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLineDiff(t *testing.T) {
+	tests := []struct {
+		a, b, want string
+	}{
+		{"a\nb\n", "a\nb\n", " a\n b\n"},
+		{"a\nb\n", "a\nc\n", " a\n-b\n+c\n"},
+		{"a\n", "a\nb\n", " a\n+b\n"},
+		{"a\nb\nc\n", "a\nc\n", " a\n-b\n c\n"},
+		{"replicas: 1\nimage: app:v1\n", "replicas: 2\nimage: app:v1\n", "-replicas: 1\n+replicas: 2\n image: app:v1\n"},
+	}
+	for _, tt := range tests {
+		if got := lineDiff(tt.a, tt.b); got != tt.want {
+			t.Errorf("lineDiff(%q, %q) = %q, want %q", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestPlanScaffold(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "scaffold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	defer func(o, p string) { OutputDir, PackDir = o, p }(OutputDir, PackDir)
+	OutputDir, PackDir = tmp, filepath.Join(tmp, "packs")
+
+	const edited = "overlays/prod/kustomization.yaml"
+	edit := func(dir string) {
+		name := filepath.Join(dir, filepath.FromSlash(edited))
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, append(data, "# mine\n"...), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	app := filepath.Join(tmp, "web")
+	steps := []struct {
+		name     string
+		edit     bool
+		existing string
+		dir      string
+		// action is that of every file but the edited one
+		action, editedAction string
+		conflict             bool
+		// mine is whether the edit is still there afterwards
+		mine bool
+	}{
+		{name: "new app", dir: app, action: fileCreate, editedAction: fileCreate},
+		{name: "again", dir: app, action: fileUnchanged, editedAction: fileUnchanged},
+		{name: "edited", edit: true, dir: app, action: fileUnchanged, editedAction: fileExists, conflict: true, mine: true},
+		{name: "skip", existing: existingSkip, dir: app, action: fileUnchanged, editedAction: fileSkip, mine: true},
+		{name: "overwrite", existing: existingOverwrite, dir: app, action: fileUnchanged, editedAction: fileOverwrite},
+		{name: "new directory", edit: true, existing: existingNew, dir: app + "-2", action: fileCreate, editedAction: fileCreate},
+	}
+	for _, step := range steps {
+		if step.edit {
+			edit(app)
+		}
+		g := generateType{AppName: "web", Image: "nginx:1.19", Existing: step.existing,
+			Environments: []environment{{Name: "dev"}, {Name: "prod", Replicas: 3}}}
+		preview, err := planScaffold(context.Background(), &g)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		plan, err := handlerTemplate(context.Background(), &g)
+		if ferr, ok := err.(*existingFilesError); step.conflict {
+			if !ok || len(ferr.Files) != 1 || ferr.Files[0] != edited {
+				t.Errorf("%s: handlerTemplate() = %v, want %s to exist", step.name, err, edited)
+			}
+		} else if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if !reflect.DeepEqual(plan, preview) {
+			t.Errorf("%s: wrote %+v, previewed %+v", step.name, plan, preview)
+		}
+		if plan.Dir != step.dir {
+			t.Errorf("%s: wrote to %s, want %s", step.name, plan.Dir, step.dir)
+		}
+		if len(plan.Files) != 11 {
+			t.Errorf("%s: %d files, want 3 in base and 4 per overlay", step.name, len(plan.Files))
+		}
+		for _, f := range plan.Files {
+			want := step.action
+			if f.Path == edited {
+				want = step.editedAction
+			}
+			if f.Action != want {
+				t.Errorf("%s: %s is to %s, want %s", step.name, f.Path, f.Action, want)
+			}
+			// a diff for every file that is there with other content
+			if hasDiff := f.Diff != ""; hasDiff != (f.Action == fileExists || f.Action == fileSkip || f.Action == fileOverwrite) {
+				t.Errorf("%s: %s to %s with diff %q", step.name, f.Path, f.Action, f.Diff)
+			}
+			if f.Diff != "" && !strings.HasSuffix(f.Diff, "-# mine\n") {
+				t.Errorf("%s: diff of %s is\n%s", step.name, f.Path, f.Diff)
+			}
+		}
+		data, err := ioutil.ReadFile(filepath.Join(plan.Dir, filepath.FromSlash(edited)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mine := strings.Contains(string(data), "# mine"); mine != step.mine {
+			t.Errorf("%s: edit kept %v, want %v", step.name, mine, step.mine)
+		}
+		if !strings.Contains(string(data), "namespace: prod\n") {
+			t.Errorf("%s: %s is\n%s", step.name, edited, data)
+		}
+	}
+}
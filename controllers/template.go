@@ -38,7 +38,7 @@ kind: Deployment
 metadata:
   name: {{ .AppName }}
 spec:
-  replicas: 1
+  replicas: {{ .Replicas }}
   template:
     spec:
       containers:
@@ -99,5 +99,8 @@ patchesStrategicMerge:
 - healthcheck_patch.yaml
 - memorylimit_patch.yaml
 namespace: {{ .Namespace }}
-`
+{{ if .ImageTag }}images:
+- name: {{ .ImageName }}
+  newTag: {{ .ImageTag }}
+{{ end }}`
 )
@@ -0,0 +1,316 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-openapi/spec"
+	"github.com/labstack/echo/v4"
+	"sigs.k8s.io/kustomize/api/resid"
+	"sigs.k8s.io/kustomize/api/resmap"
+	"sigs.k8s.io/kustomize/kyaml/openapi/kubernetesapi"
+)
+
+// kubeVersionNone turns validation off. An empty kustType.KubeVersion
+// validates against the schema built into kyaml, any other version against
+// the bundle of that name in SchemaDir.
+const kubeVersionNone = "none"
+
+// SchemaDir holds offline OpenAPI bundles to validate builds against, the
+// swagger.json of a Kubernetes version saved as e.g. v1.18.json. Empty
+// means the schemas directory in the config directory.
+var SchemaDir string
+
+const builtinSchema = "openapi/kubernetesapi/swagger.json"
+
+// Definitions that take more than their declared type. A Quantity such as
+// cpu: 1 is as often written as a number as it is as a string.
+var looseDefinitions = map[string]bool{
+	"io.k8s.apimachinery.pkg.api.resource.Quantity": true,
+}
+
+var kubeVersionName = regexp.MustCompile(`^v?[0-9][0-9A-Za-z.+-]*$`)
+
+type validationError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+type resourceValidation struct {
+	resourceInfo
+	Errors []validationError `json:"errors"`
+}
+
+type kubeVersions struct {
+	Builtin  string   `json:"builtin"`
+	Versions []string `json:"versions"`
+	Dir      string   `json:"dir"`
+}
+
+// kubeSchema is the OpenAPI schema of one Kubernetes version, with its
+// definitions indexed by the kind they describe.
+type kubeSchema struct {
+	Version string
+	defs    spec.Definitions
+	byGVK   map[resid.Gvk]string
+}
+
+var (
+	schemasMu sync.Mutex
+	schemas   = make(map[string]*kubeSchema)
+)
+
+func schemaDir() (string, error) {
+	if SchemaDir != "" {
+		return expandHome(SchemaDir)
+	}
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "schemas"), nil
+}
+
+// listKubeVersions lists the versions builds can be validated against.
+func listKubeVersions() (*kubeVersions, error) {
+	builtin, err := loadSchema("")
+	if err != nil {
+		return nil, err
+	}
+	dir, err := schemaDir()
+	if err != nil {
+		return nil, err
+	}
+	list := &kubeVersions{Builtin: builtin.Version, Versions: []string{}, Dir: dir}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	for _, f := range files {
+		if v := strings.TrimSuffix(filepath.Base(f), ".json"); kubeVersionName.MatchString(v) {
+			list.Versions = append(list.Versions, v)
+		}
+	}
+	sort.Strings(list.Versions)
+	return list, nil
+}
+
+// loadSchema reads the schema of version, once.
+func loadSchema(version string) (*kubeSchema, error) {
+	schemasMu.Lock()
+	defer schemasMu.Unlock()
+	if s, ok := schemas[version]; ok {
+		return s, nil
+	}
+
+	var data []byte
+	var err error
+	if version == "" {
+		data, err = kubernetesapi.Asset(builtinSchema)
+	} else {
+		if !kubeVersionName.MatchString(version) {
+			return nil, fmt.Errorf("invalid Kubernetes version %q", version)
+		}
+		var dir string
+		if dir, err = schemaDir(); err != nil {
+			return nil, err
+		}
+		data, err = ioutil.ReadFile(filepath.Join(dir, version+".json"))
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no schema for Kubernetes %s in %s", version, dir)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Info struct {
+			Version string `json:"version"`
+		} `json:"info"`
+		Definitions spec.Definitions `json:"definitions"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("schema %s: %v", version, err)
+	}
+
+	s := &kubeSchema{Version: doc.Info.Version, defs: doc.Definitions, byGVK: make(map[resid.Gvk]string)}
+	if s.Version == "" {
+		s.Version = version
+	}
+	for name, def := range doc.Definitions {
+		gvks, _ := def.Extensions["x-kubernetes-group-version-kind"].([]interface{})
+		for _, item := range gvks {
+			m, _ := item.(map[string]interface{})
+			group, _ := m["group"].(string)
+			version, _ := m["version"].(string)
+			kind, _ := m["kind"].(string)
+			s.byGVK[resid.Gvk{Group: group, Version: version, Kind: kind}] = name
+		}
+	}
+	schemas[version] = s
+	return s, nil
+}
+
+// validateResources checks every resource of m against the schema of
+// version and returns those with errors. Kinds the schema doesn't know,
+// such as custom resources, are only warned about.
+func validateResources(m resmap.ResMap, version string) ([]resourceValidation, []string, error) {
+	found := []resourceValidation{}
+	if version == kubeVersionNone {
+		return found, nil, nil
+	}
+	s, err := loadSchema(version)
+	if err != nil {
+		return nil, nil, err
+	}
+	var warnings []string
+	for _, r := range m.Resources() {
+		info := newResourceInfo(r)
+		name, ok := s.byGVK[r.GetGvk()]
+		if !ok {
+			warnings = append(warnings, fmt.Sprintf("%s: no schema in Kubernetes %s, not validated", info, s.Version))
+			continue
+		}
+		var errs []validationError
+		s.validate(&errs, "", r.Map(), s.defs[name], name)
+		if len(errs) > 0 {
+			found = append(found, resourceValidation{resourceInfo: info, Errors: errs})
+		}
+	}
+	return found, warnings, nil
+}
+
+// validate appends what is wrong with v, found at path, to out. It checks
+// types, unknown fields and required fields, which is what kubectl's
+// client-side validation catches.
+func (s *kubeSchema) validate(out *[]validationError, path string, v interface{}, sch spec.Schema, name string) {
+	for ref := sch.Ref.String(); ref != ""; ref = sch.Ref.String() {
+		name = strings.TrimPrefix(ref, "#/definitions/")
+		def, ok := s.defs[name]
+		if !ok {
+			return
+		}
+		sch = def
+	}
+	if v == nil {
+		return
+	}
+	if preserve, _ := sch.Extensions["x-kubernetes-preserve-unknown-fields"].(bool); preserve {
+		return
+	}
+	fail := func(format string, args ...interface{}) {
+		*out = append(*out, validationError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+	if sch.Format == "int-or-string" || looseDefinitions[name] {
+		if t := typeName(v); t != "string" && t != "integer" && t != "number" {
+			fail("expected a string or a number, got %s", t)
+		}
+		return
+	}
+
+	typ := ""
+	if len(sch.Type) > 0 {
+		typ = sch.Type[0]
+	} else if len(sch.Properties) > 0 {
+		typ = "object"
+	}
+	switch typ {
+	case "object":
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			fail("expected object, got %s", typeName(v))
+			return
+		}
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if p, ok := sch.Properties[k]; ok {
+				s.validate(out, fieldPath(path, k), m[k], p, "")
+				continue
+			}
+			if ap := sch.AdditionalProperties; ap != nil && (ap.Allows || ap.Schema != nil) {
+				if ap.Schema != nil {
+					s.validate(out, fieldPath(path, k), m[k], *ap.Schema, "")
+				}
+				continue
+			}
+			if len(sch.Properties) > 0 {
+				*out = append(*out, validationError{Path: fieldPath(path, k), Message: "unknown field " + strconv.Quote(k)})
+			}
+		}
+		for _, req := range sch.Required {
+			if _, ok := m[req]; !ok {
+				fail("missing required field %q", req)
+			}
+		}
+	case "array":
+		list, ok := v.([]interface{})
+		if !ok {
+			fail("expected array, got %s", typeName(v))
+			return
+		}
+		if sch.Items == nil || sch.Items.Schema == nil {
+			return
+		}
+		for i, item := range list {
+			s.validate(out, itemPath(path, i, item), item, *sch.Items.Schema, "")
+		}
+	case "string", "integer", "number", "boolean":
+		t := typeName(v)
+		if t != typ && !(typ == "number" && t == "integer") {
+			fail("expected %s, got %s", typ, t)
+		}
+	}
+}
+
+// itemPath names a list item like the diff does, by name where it has one.
+func itemPath(path string, i int, item interface{}) string {
+	if m, ok := item.(map[string]interface{}); ok {
+		if name, ok := m["name"].(string); ok {
+			return path + "[name=" + name + "]"
+		}
+	}
+	return path + "[" + strconv.Itoa(i) + "]"
+}
+
+// typeName names the JSON type of a decoded value.
+func typeName(v interface{}) string {
+	switch n := v.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case int, int32, int64:
+		return "integer"
+	case float64:
+		if n == math.Trunc(n) {
+			return "integer"
+		}
+		return "number"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// KubeVersions lists the Kubernetes versions for the validation picker.
+func KubeVersions(c echo.Context) error {
+	list, err := listKubeVersions()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, list)
+}
@@ -0,0 +1,125 @@
+package controllers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidateResources(t *testing.T) {
+	tests := []struct {
+		name     string
+		yaml     string
+		want     []validationError
+		warnings int
+	}{
+		{
+			name: "valid",
+			yaml: `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 2
+  selector:
+    matchLabels: {app: web}
+  template:
+    metadata:
+      labels: {app: web}
+    spec:
+      containers:
+      - name: web
+        image: nginx:1.19
+        ports:
+        - containerPort: 80
+        resources:
+          limits: {cpu: 1, memory: 1Gi}
+`,
+		},
+		{
+			name: "wrong types and unknown fields",
+			yaml: `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: "2"
+  selector:
+    matchLabels: {app: web}
+  template:
+    spec:
+      containers:
+      - name: web
+        image: nginx:1.19
+        port: 80
+        ports:
+        - containerPort: http
+`,
+			want: []validationError{
+				{Path: "spec.replicas", Message: "expected integer, got string"},
+				{Path: "spec.template.spec.containers[name=web].port", Message: `unknown field "port"`},
+				{Path: "spec.template.spec.containers[name=web].ports[0].containerPort", Message: "expected integer, got string"},
+			},
+		},
+		{
+			name: "missing required field",
+			yaml: `apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+spec:
+  containers:
+  - image: nginx:1.19
+`,
+			want: []validationError{
+				{Path: "spec.containers[0]", Message: `missing required field "name"`},
+			},
+		},
+		{
+			name: "custom resource",
+			yaml: `apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: web
+spec:
+  anything: goes
+`,
+			warnings: 1,
+		},
+	}
+	for _, tt := range tests {
+		found, warnings, err := validateResources(resMapOf(t, tt.yaml), "")
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var got []validationError
+		for _, r := range found {
+			got = append(got, r.Errors...)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: errors %v, want %v", tt.name, got, tt.want)
+		}
+		if len(warnings) != tt.warnings {
+			t.Errorf("%s: warnings %v, want %d", tt.name, warnings, tt.warnings)
+		}
+	}
+}
+
+func TestValidateResourcesNone(t *testing.T) {
+	found, warnings, err := validateResources(resMapOf(t, `apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+spec:
+  containers: nope
+`), kubeVersionNone)
+	if err != nil || len(found) != 0 || len(warnings) != 0 {
+		t.Errorf("validation turned off returned %v, %v, %v", found, warnings, err)
+	}
+}
+
+func TestLoadSchemaVersionName(t *testing.T) {
+	if _, err := loadSchema("../../etc/passwd"); err == nil {
+		t.Error("loadSchema accepted a path as the version")
+	}
+}
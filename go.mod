@@ -3,8 +3,16 @@ module github.com/sunny0826/kustomize-remote-observer
 go 1.13
 
 require (
+	github.com/go-openapi/spec v0.19.5
 	github.com/labstack/echo/v4 v4.1.16
 	github.com/labstack/gommon v0.3.0
+	github.com/qri-io/starlib v0.4.2-0.20200213133954-ff2e8cd5ef8d
+	github.com/zalando/go-keyring v0.2.1
 	github.com/zserge/lorca v0.1.9
+	go.starlark.net v0.0.0-20201006213952-227f4aabceb5
+	k8s.io/apimachinery v0.17.0
+	k8s.io/client-go v0.17.0
 	sigs.k8s.io/kustomize/api v0.5.0
+	sigs.k8s.io/kustomize/kyaml v0.3.4
+	sigs.k8s.io/yaml v1.2.0
 )
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -18,21 +19,92 @@ import (
 	"runtime"
 )
 
+const usage = `Usage: observer [command]
+
+Without a command the observer opens its window, which needs a display.
+
+Commands:
+  build      build a remote kustomization and print the YAML
+  diff       compare two builds, or a build and a cluster, resource by resource
+  apply      apply a build to a cluster after a server-side dry run
+  generate   scaffold a kustomize file group
+  serve      run the web UI as a standalone HTTP server
+  cache      list or purge the build cache
+`
+
 func main() {
+	// git runs this executable as GIT_ASKPASS to fetch private repos.
+	if controllers.AskPass(os.Args[1:], os.Stdout) {
+		return
+	}
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+	if !hasDisplay() {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	runGUI()
+}
+
+// runCommand runs one of the headless subcommands and returns the exit code.
+func runCommand(name string, args []string) int {
+	// commands run on the user's own machine, serve decides for itself
+	controllers.LocalFiles = true
+	controllers.Clusters = true
+	controllers.Profiles = true
+	var err error
+	switch name {
+	case "build":
+		err = controllers.BuildCommand(args, os.Stdout)
+	case "diff":
+		err = controllers.DiffCommand(args, os.Stdout)
+		if err == controllers.ErrDifferences {
+			return 1
+		}
+	case "apply":
+		err = controllers.ApplyCommand(args, os.Stdin, os.Stdout)
+	case "generate":
+		err = controllers.GenerateCommand(args, os.Stdout)
+	case "serve":
+		err = serveCommand(args)
+	case "cache":
+		err = controllers.CacheCommand(args, os.Stdout)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(os.Stdout, usage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", name, usage)
+		return 2
+	}
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	return 0
+}
+
+// hasDisplay reports whether a window can be opened. Only X11 and Wayland
+// sessions can be missing one; macOS and Windows always have a desktop.
+func hasDisplay() bool {
+	if runtime.GOOS != "linux" {
+		return true
+	}
+	return os.Getenv("DISPLAY") != "" || os.Getenv("WAYLAND_DISPLAY") != ""
+}
+
+func runGUI() {
 	args := []string{}
 	if runtime.GOOS == "linux" {
 		args = append(args, "--class=Lorca")
 	}
 	ui, err := lorca.New("", "", 480, 700, args...)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("%v\nChrome is required for the window, use \"observer build\", \"observer generate\" or \"observer serve\" without it", err)
 	}
-	// Echo instance
-	e := echo.New()
-
-	// Middleware
-	e.Use(middleware.Logger())
-	e.Use(middleware.Recover())
 
 	ep, err := os.Executable()
 	if err != nil {
@@ -43,6 +115,40 @@ func main() {
 		log.Fatalln("os.Chdir:", err)
 	}
 
+	controllers.LocalFiles = true
+	controllers.Clusters = true
+	controllers.Profiles = true
+	controllers.AllowedHosts = []string{"127.0.0.1:1323", "localhost:1323"}
+	e := newServer()
+	// Start server, on loopback only since the window opens up this
+	// machine's files and clusters
+	go e.Start("127.0.0.1:1323")
+
+	ui.Load(fmt.Sprintf("http://%s", "127.0.0.1:1323"))
+	defer ui.Close()
+	//e.Logger.Fatal(e.Start(":1323"))
+
+	// Wait until the interrupt signal arrives or browser window is closed
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt)
+	select {
+	case <-sigc:
+	case <-ui.Done():
+	}
+
+}
+
+// newServer sets up the echo instance shared by the window and serve mode.
+// Views and assets are loaded relative to the working directory.
+func newServer() *echo.Echo {
+	// Echo instance
+	e := echo.New()
+
+	// Middleware
+	e.Use(middleware.Logger())
+	e.Use(middleware.Recover())
+	e.Use(controllers.SameOrigin)
+
 	// Static
 	e.Static("/assets", "assets")
 	e.File("/favicon.ico", "assets/images/favicon.ico")
@@ -54,25 +160,45 @@ func main() {
 
 	// Routes
 	e.POST("/kust", controllers.HandlerKust)
+	e.GET("/kust/:id", controllers.JobResult)
+	e.POST("/compare", controllers.HandlerCompare)
 	e.POST("/gene", controllers.GenerateKust)
+	e.GET("/gene/output", controllers.GetOutputDir)
+	e.POST("/gene/output", controllers.SaveOutputDir)
+	e.GET("/gene/packs", controllers.ListPacks)
+	e.GET("/gene/pack", controllers.GetPack)
+	e.GET("/healthz", controllers.Health)
+	e.GET("/ssh/keys", controllers.SSHKeys)
+	// profiles hand out the secrets of this machine, so they are only
+	// there when it is the user's own
+	if controllers.Profiles {
+		e.GET("/profiles", controllers.ListProfiles)
+		e.POST("/profiles", controllers.SaveProfile)
+		e.DELETE("/profiles/:name", controllers.DeleteProfile)
+	}
+	e.GET("/fs/dirs", controllers.BrowseDirs)
+	e.GET("/cache", controllers.InspectCache)
+	e.DELETE("/cache", controllers.PurgeCache)
+	e.GET("/schemas", controllers.KubeVersions)
+	e.GET("/cluster/contexts", controllers.ListContexts)
+	e.POST("/cluster/diff", controllers.HandlerClusterDiff)
+
+	api := e.Group("/api/v1")
+	api.POST("/build", controllers.APIBuild)
+	api.POST("/diff", controllers.APICompare)
+	api.POST("/cluster/diff", controllers.APIClusterDiff)
+	api.POST("/cluster/apply", controllers.APIApply)
+	api.POST("/export", controllers.APIExport)
+	api.POST("/generate", controllers.APIGenerate)
+	api.POST("/jobs", controllers.StartJob)
+	api.GET("/jobs/:id", controllers.GetJob)
+	api.DELETE("/jobs/:id", controllers.CancelJob)
+	api.GET("/jobs/:id/events", controllers.JobEvents)
+
 	e.GET("/", func(c echo.Context) error {
 		return c.Render(http.StatusOK, "index.html", "")
 	})
-	// Start server
-	go e.Start(":1323")
-
-	ui.Load(fmt.Sprintf("http://%s", "localhost:1323"))
-	defer ui.Close()
-	//e.Logger.Fatal(e.Start(":1323"))
-
-	// Wait until the interrupt signal arrives or browser window is closed
-	sigc := make(chan os.Signal)
-	signal.Notify(sigc, os.Interrupt)
-	select {
-	case <-sigc:
-	case <-ui.Done():
-	}
-
+	return e
 }
 
 // TemplateRenderer is a custom html/template renderer for Echo framework
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/sunny0826/kustomize-remote-observer/controllers"
+)
+
+// serveCommand runs the web UI without a window until SIGINT or SIGTERM,
+// then drains in-flight requests before returning.
+func serveCommand(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := fs.String("addr", "", "address to bind, empty for all interfaces")
+	port := fs.Int("port", 1323, "port to listen on")
+	certFile := fs.String("tls-cert", "", "TLS certificate file, enables HTTPS together with -tls-key")
+	keyFile := fs.String("tls-key", "", "TLS private key file")
+	resources := fs.String("resources", "", "directory holding views and assets, detected from the executable if empty")
+	localFiles := fs.Bool("local-files", false, "allow building and browsing directories on this machine")
+	schemaDir := fs.String("schema-dir", "", "directory of offline OpenAPI schemas named <version>.json, in the config directory if empty")
+	lintConfig := fs.String("lint-config", "", "lint rules to enable, disable or add, lint.yaml in the config directory if empty")
+	outputDir := fs.String("output-dir", "", "directory generate writes to, the default saved in the UI, Desktop or home directory if empty")
+	packDir := fs.String("pack-dir", "", "directory of template packs for generate, packs in the config directory if empty")
+	clusters := fs.Bool("clusters", false, "allow diffing against and applying to the clusters of this machine's kubeconfig")
+	profiles := fs.Bool("profiles", false, "allow saving profiles and building with their secrets, also allowed by -local-files")
+	maxJobs := fs.Int("max-jobs", controllers.MaxJobs, "background builds running at once, 0 for no limit")
+	maxRetained := fs.Int("max-retained-jobs", controllers.MaxRetainedJobs, "background builds kept for fetching, 0 for no limit")
+	buildTimeout := fs.Duration("build-timeout", controllers.BuildTimeout, "give up on a build after this long, 0 for no limit")
+	grace := fs.Duration("shutdown-timeout", 30*time.Second, "how long to wait for running builds on shutdown")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: observer serve [flags]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if (*certFile == "") != (*keyFile == "") {
+		return fmt.Errorf("serve: -tls-cert and -tls-key must be set together")
+	}
+
+	dir := *resources
+	if dir == "" {
+		dir = findResources()
+	}
+	if err := os.Chdir(dir); err != nil {
+		return err
+	}
+
+	controllers.LocalFiles = *localFiles
+	controllers.Clusters = *clusters
+	controllers.Profiles = *profiles || *localFiles
+	controllers.SchemaDir = *schemaDir
+	controllers.LintConfig = *lintConfig
+	controllers.OutputDir = *outputDir
+	controllers.PackDir = *packDir
+	controllers.BuildTimeout = *buildTimeout
+	controllers.MaxJobs = *maxJobs
+	controllers.MaxRetainedJobs = *maxRetained
+	e := newServer()
+	e.HideBanner = true
+	address := net.JoinHostPort(*addr, strconv.Itoa(*port))
+	errc := make(chan error, 1)
+	go func() {
+		if *certFile != "" {
+			errc <- e.StartTLS(address, *certFile, *keyFile)
+		} else {
+			errc <- e.Start(address)
+		}
+	}()
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-errc:
+		return err
+	case sig := <-sigc:
+		log.Printf("received %s, shutting down", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *grace)
+	defer cancel()
+	if err := e.Shutdown(ctx); err != nil {
+		return err
+	}
+	if err := <-errc; err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// findResources looks for the views directory inside a macOS app bundle,
+// next to the executable, and finally in the working directory.
+func findResources() string {
+	if ep, err := os.Executable(); err == nil {
+		for _, dir := range []string{
+			filepath.Join(filepath.Dir(ep), "..", "Resources"),
+			filepath.Dir(ep),
+		} {
+			if fi, err := os.Stat(filepath.Join(dir, "views")); err == nil && fi.IsDir() {
+				return dir
+			}
+		}
+	}
+	return "."
+}